@@ -1,104 +1,210 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 
-	"github.com/beppler/gstow/internal/stow"
+	"github.com/beppler/gstow/stow"
 )
 
 const (
 	exitSuccess    = 0
 	exitConflicts  = 1
 	exitValidation = 2
+	exitDrift      = 3
+	// exitInterrupted follows the shell convention for SIGINT.
+	exitInterrupted = 130
 )
 
 func main() {
-	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
 }
 
-func run(args []string, stdout, stderr io.Writer) int {
-	fs := flag.NewFlagSet("stow", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-
-	dryRunShort := fs.Bool("n", false, "dry-run; do not make changes")
-	dryRunLong := fs.Bool("no", false, "dry-run; do not make changes")
-	dir := fs.String("d", ".", "stow directory")
-	dirLong := fs.String("dir", "", "stow directory")
-	target := fs.String("t", "", "target directory")
-	targetLong := fs.String("target", "", "target directory")
-
-	if err := fs.Parse(args); err != nil {
-		stowDir := *dir
-		if *dirLong != "" {
-			stowDir = *dirLong
-		}
-		stowTarget := resolveTarget(stowDir, *target, *targetLong)
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	var command string
+	if len(args) > 0 && (args[0] == "status" || args[0] == "prune") {
+		command, args = args[0], args[1:]
+	}
+
+	rcArgs, err := loadStowrcFiles()
+	if err != nil {
+		writeError(stderr, errorPath(err), err)
+		return exitValidation
+	}
+	args = append(rcArgs, args...)
+
+	var (
+		dryRun, noFolding, absolute, adopt, dotfiles bool
+		ignore, deferPatterns, overridePatterns      []string
+		exclude                                      []string
+		verbose                                      verbosity
+		format                                       = formatText
+		dir                                          = "."
+		target                                       string
+		onConflict                                   = stow.ConflictSkip.String()
+		backupDir                                    string
+		packages                                     []string
+		actions                                      []stow.PackageAction
+	)
+	// -S, -D and -R switch the action applied to the packages that follow.
+	action := stow.ActionStow
+	actionOption := func(long string, short byte, a stow.Action) option {
+		return option{long: long, short: short, set: func(string, bool) error {
+			action = a
+			return nil
+		}}
+	}
+	operand := func(pkg string) {
+		packages = append(packages, pkg)
+		actions = append(actions, stow.PackageAction{Package: pkg, Action: action})
+	}
+	options := []option{
+		boolOption("no", 'n', &dryRun),
+		boolOption("simulate", 0, &dryRun),
+		actionOption("stow", 'S', stow.ActionStow),
+		actionOption("delete", 'D', stow.ActionDelete),
+		actionOption("restow", 'R', stow.ActionRestow),
+		boolOption("no-folding", 0, &noFolding),
+		boolOption("absolute", 0, &absolute),
+		boolOption("adopt", 0, &adopt),
+		boolOption("dotfiles", 0, &dotfiles),
+		listOption("ignore", &ignore),
+		listOption("defer", &deferPatterns),
+		listOption("override", &overridePatterns),
+		listOption("exclude", &exclude),
+		// --all stands for every package, under the current action.
+		{long: "all", set: func(string, bool) error {
+			operand(stow.AllPackages)
+			return nil
+		}},
+		{long: "verbose", short: 'v', arg: optionalArg, set: verbose.set},
+		stringOption("format", 0, &format),
+		stringOption("on-conflict", 0, &onConflict),
+		stringOption("backup-dir", 0, &backupDir),
+		stringOption("dir", 'd', &dir),
+		stringOption("target", 't', &target),
+	}
+
+	if err := parseArgs(options, args, operand); err != nil {
+		stowTarget := resolveTarget(dir, target)
 		if stowTarget == "" {
-			stowTarget = stowDir
+			stowTarget = dir
 		}
 		writeError(stderr, stowTarget, err)
 		return exitValidation
 	}
 
-	dryRun := *dryRunShort || *dryRunLong
-	stowDir := *dir
-	if *dirLong != "" {
-		stowDir = *dirLong
+	stowDir := dir
+	stowTarget := resolveTarget(stowDir, target)
+	rep, err := newReporter(format, stdout, stderr)
+	if err != nil {
+		path := stowTarget
+		if path == "" {
+			path = stowDir
+		}
+		writeError(stderr, path, err)
+		return exitValidation
+	}
+	// From here on errors go through the reporter, so that --format=json
+	// and ndjson report them on stdout.
+	fail := func(path string, err error) int {
+		rep.error(path, err)
+		rep.close(exitValidation)
+		return exitValidation
 	}
 
-	stowTarget := resolveTarget(stowDir, *target, *targetLong)
 	if stowTarget == "" {
 		defaultTarget, err := stow.DefaultTarget(stowDir)
 		if err != nil {
-			writeError(stderr, stowDir, err)
-			return exitValidation
+			return fail(stowDir, err)
 		}
 		stowTarget = defaultTarget
 	}
-
-	packages := fs.Args()
-	if len(packages) == 0 {
-		writeError(stderr, stowTarget, errors.New("at least one package is required"))
-		return exitValidation
+	policy, err := stow.ParseConflictPolicy(onConflict)
+	if err != nil {
+		return fail(stowTarget, err)
 	}
 
-	plan, err := stow.BuildPlan(stow.Options{
-		Dir:      stowDir,
-		Target:   stowTarget,
-		Packages: packages,
-	})
+	stowOpts := []stow.Option{
+		stow.WithTarget(stowTarget),
+		stow.WithNoFolding(noFolding),
+		stow.WithAdopt(adopt),
+		stow.WithIgnore(ignore...),
+		stow.WithDefer(deferPatterns...),
+		stow.WithOverride(overridePatterns...),
+		stow.WithExclude(exclude...),
+		stow.WithDotfiles(dotfiles),
+		stow.WithConflictPolicy(policy),
+		stow.WithBackupDir(backupDir),
+		stow.WithAbsoluteLinks(absolute),
+		stow.WithDryRun(dryRun),
+	}
+	if verbose > 0 {
+		stowOpts = append(stowOpts, stow.WithLogger(stow.NewLogger(stderr, int(verbose))))
+	}
+	s, err := stow.New(stowDir, stowOpts...)
 	if err != nil {
-		path := ""
-		var perr *stow.PathError
-		if errors.As(err, &perr) {
-			path = perr.Path
+		return fail(stowDir, err)
+	}
+
+	var code int
+	switch command {
+	case "status":
+		code = runStatus(ctx, s, packages, rep)
+	case "prune":
+		plan, err := s.PlanPrune(ctx, packages...)
+		code = runPlan(ctx, s, plan, err, dryRun, rep)
+	default:
+		if len(packages) == 0 {
+			rep.error(stowTarget, stow.ErrNoPackages)
+			code = exitValidation
+			break
 		}
-		writeError(stderr, path, err)
-		return exitValidation
+		plan, err := s.Plan(ctx, actions...)
+		code = runPlan(ctx, s, plan, err, dryRun, rep)
 	}
+	rep.close(code)
+	return code
+}
 
-	for _, conflict := range plan.Conflicts {
-		writeConflict(stderr, conflict.Target, conflict.Reason)
+// runPlan reports the conflicts and operations of the plan, or the error
+// planning returned, and applies it.
+func runPlan(ctx context.Context, s *stow.Stower, plan stow.Plan, err error, dryRun bool, rep reporter) int {
+	var cerr *stow.ConflictError
+	if errors.As(err, &cerr) {
+		// --on-conflict=fail: report the conflicts and change nothing.
+		rep.plan(plan)
+		for _, conflict := range cerr.Conflicts {
+			rep.conflict(conflict)
+		}
+		return exitConflicts
+	}
+	if err != nil {
+		return reportError(err, rep)
 	}
 
+	rep.plan(plan)
+	for _, conflict := range plan.Conflicts {
+		rep.conflict(conflict)
+	}
 	for _, op := range plan.Operations {
-		fmt.Fprintf(stdout, "LINK %s -> %s\n", op.Target, op.Source)
+		rep.operation(op)
 	}
 
-	if err := stow.Execute(plan, stow.ExecuteOptions{DryRun: dryRun}); err != nil {
-		path := ""
-		var oerr *stow.OpError
-		if errors.As(err, &oerr) {
-			path = oerr.Target
-		}
-		writeError(stderr, path, err)
-		return exitValidation
+	if err := s.Apply(ctx, plan); err != nil {
+		return reportError(err, rep)
 	}
+	rep.executed(dryRun)
 
 	if len(plan.Conflicts) > 0 {
 		return exitConflicts
@@ -106,8 +212,98 @@ func run(args []string, stdout, stderr io.Writer) int {
 	return exitSuccess
 }
 
-func writeConflict(w io.Writer, target, reason string) {
-	fmt.Fprintf(w, "CONFLICT %s: %s\n", target, reason)
+// runStatus reports the stow state of each package and returns exitDrift when
+// any package is not fully stowed.
+func runStatus(ctx context.Context, s *stow.Stower, packages []string, rep reporter) int {
+	statuses, err := s.Status(ctx, packages...)
+	if err != nil {
+		return reportError(err, rep)
+	}
+
+	code := exitSuccess
+	for _, status := range statuses {
+		rep.status(status)
+		if status.Drifted() {
+			code = exitDrift
+		}
+	}
+	return code
+}
+
+// reportError reports a planning or execution error, followed by each
+// operation a failed rollback left in place, and returns the exit code.
+func reportError(err error, rep reporter) int {
+	rep.error(errorPath(err), err)
+	var oerr *stow.OpError
+	if errors.As(err, &oerr) {
+		for _, op := range oerr.Applied {
+			rep.error(op.Target, fmt.Errorf("%s was not undone", op.Kind))
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+	return exitValidation
+}
+
+// errorPath returns the path carried by planning and execution errors.
+func errorPath(err error) string {
+	var oerr *stow.OpError
+	if errors.As(err, &oerr) {
+		return oerr.Target
+	}
+	var perr *stow.PathError
+	if errors.As(err, &perr) {
+		return perr.Path
+	}
+	return ""
+}
+
+// verbosity is the -v/--verbose level. Without a value each occurrence adds
+// one; --verbose=N sets the level.
+type verbosity int
+
+func (v *verbosity) set(value string, hasValue bool) error {
+	if !hasValue {
+		*v++
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid verbosity %q", value)
+	}
+	*v = verbosity(n)
+	return nil
+}
+
+func writeOperation(w io.Writer, op stow.Operation) {
+	switch op.Kind {
+	case stow.OpUnlink, stow.OpMkdir, stow.OpRmdir, stow.OpRemove:
+		fmt.Fprintf(w, "%s %s\n", op.Kind, op.Target)
+	default:
+		fmt.Fprintf(w, "%s %s -> %s\n", op.Kind, op.Target, op.Source)
+	}
+}
+
+// writeConflict prints the conflict followed by what exists at the target,
+// for example "(existing symlink -> /stow/vim/.vimrc, package vim)".
+func writeConflict(w io.Writer, conflict stow.Conflict) {
+	var details []string
+	if conflict.Existing != stow.FileNone {
+		existing := "existing " + conflict.Existing.String()
+		if conflict.LinkDest != "" {
+			existing += " -> " + conflict.LinkDest
+		}
+		details = append(details, existing)
+	}
+	if conflict.Package != "" {
+		details = append(details, "package "+conflict.Package)
+	}
+	if len(details) == 0 {
+		fmt.Fprintf(w, "CONFLICT %s: %s\n", conflict.Target, conflict.Reason)
+		return
+	}
+	fmt.Fprintf(w, "CONFLICT %s: %s (%s)\n", conflict.Target, conflict.Reason, strings.Join(details, ", "))
 }
 
 func writeError(w io.Writer, target string, err error) {
@@ -119,12 +315,9 @@ func writeError(w io.Writer, target string, err error) {
 	fmt.Fprintf(w, "ERROR %s: %v\n", path, err)
 }
 
-func resolveTarget(stowDir, targetShort, targetLong string) string {
-	if strings.TrimSpace(targetLong) != "" {
-		return targetLong
-	}
-	if strings.TrimSpace(targetShort) != "" {
-		return targetShort
+func resolveTarget(stowDir, target string) string {
+	if strings.TrimSpace(target) != "" {
+		return target
 	}
 	if strings.TrimSpace(stowDir) == "" {
 		return ""
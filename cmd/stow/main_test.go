@@ -2,11 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// TestMain points HOME at an empty directory so a developer's ~/.stowrc does
+// not leak into the tests.
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "gstow-home")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("USERPROFILE", home)
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
 func TestRunDryRunOutput(t *testing.T) {
 	stowDir := t.TempDir()
 	targetDir := t.TempDir()
@@ -17,7 +34,7 @@ func TestRunDryRunOutput(t *testing.T) {
 	mustWriteFile(t, source)
 
 	var stdout, stderr bytes.Buffer
-	code := run([]string{"-n", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	code := run(context.Background(), []string{"-n", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
 	if code != 0 {
 		t.Fatalf("expected exit code 0, got %d", code)
 	}
@@ -33,6 +50,91 @@ func TestRunDryRunOutput(t *testing.T) {
 	}
 }
 
+func TestRunDeleteOutput(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	linked := filepath.Join(targetDir, "alpha.txt")
+	if err := os.Symlink(source, linked); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-D", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "UNLINK " + filepath.Join(targetAbs, "alpha.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+	if _, err := os.Lstat(linked); !os.IsNotExist(err) {
+		t.Fatalf("expected symlink to be removed, got %v", err)
+	}
+}
+
+func TestRunRestowOutput(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	stale := filepath.Join(targetDir, "gone.txt")
+	if err := os.Symlink(filepath.Join(pkg, "gone.txt"), stale); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "-R", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "LINK " + filepath.Join(targetAbs, "alpha.txt") + " -> " + filepath.Join(stowDirAbs, "pkg", "alpha.txt") + "\n" +
+		"UNLINK " + filepath.Join(targetAbs, "gone.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+}
+
+func TestRunMixedActions(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	oldSource := filepath.Join(stowDir, "old", "alpha.txt")
+	mustWriteFile(t, oldSource)
+	mustWriteFile(t, filepath.Join(stowDir, "new", "bravo.txt"))
+	if err := os.Symlink(oldSource, filepath.Join(targetDir, "alpha.txt")); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-S", "new", "--dir=" + stowDir, "-D", "old", "--target", targetDir}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "UNLINK " + filepath.Join(targetAbs, "alpha.txt") + "\n" +
+		"LINK " + filepath.Join(targetAbs, "bravo.txt") + " -> " + filepath.Join(stowDirAbs, "new", "bravo.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+}
+
 func TestRunConflictExitCode(t *testing.T) {
 	stowDir := t.TempDir()
 	targetDir := t.TempDir()
@@ -46,7 +148,7 @@ func TestRunConflictExitCode(t *testing.T) {
 	mustWriteFile(t, conflict)
 
 	var stdout, stderr bytes.Buffer
-	code := run([]string{"-n", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	code := run(context.Background(), []string{"-n", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
 	if code != 1 {
 		t.Fatalf("expected exit code 1, got %d", code)
 	}
@@ -54,18 +156,389 @@ func TestRunConflictExitCode(t *testing.T) {
 		t.Fatalf("expected empty stdout, got %q", stdout.String())
 	}
 
-	expected := "CONFLICT " + conflict + ": target already exists\n"
+	expected := "CONFLICT " + conflict + ": target already exists (existing file)\n"
+	if stderr.String() != expected {
+		t.Fatalf("stderr mismatch:\n got: %q\nwant: %q", stderr.String(), expected)
+	}
+}
+
+func TestRunConflictDetails(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	other := filepath.Join(stowDir, "other", "alpha.txt")
+	mustWriteFile(t, other)
+	if err := os.Symlink(other, filepath.Join(targetDir, "alpha.txt")); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 1 {
+		t.Fatalf("expected exit code 1, got %d (stderr %q)", code, stderr.String())
+	}
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "CONFLICT " + filepath.Join(targetAbs, "alpha.txt") + ": symlink points elsewhere (existing symlink -> " +
+		filepath.Join(stowDirAbs, "other", "alpha.txt") + ", package other)\n"
 	if stderr.String() != expected {
 		t.Fatalf("stderr mismatch:\n got: %q\nwant: %q", stderr.String(), expected)
 	}
 }
 
+func TestRunOnConflictPolicies(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "bravo.txt"))
+	existing := filepath.Join(targetDir, "alpha.txt")
+	mustWriteFile(t, existing)
+
+	targetAbs, _ := filepath.Abs(targetDir)
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"--on-conflict=fail", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 1 {
+		t.Fatalf("expected exit code 1, got %d (stderr %q)", code, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("expected no operations, got %q", stdout.String())
+	}
+	if stderr.String() != "CONFLICT "+filepath.Join(targetAbs, "alpha.txt")+": target already exists (existing file)\n" {
+		t.Fatalf("unexpected stderr %q", stderr.String())
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "bravo.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected no changes, got %v", err)
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	code = run(context.Background(), []string{"-n", "--on-conflict", "backup", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+	if !strings.HasPrefix(stdout.String(), "BACKUP "+filepath.Join(targetAbs, "alpha.txt")+" -> "+filepath.Join(targetAbs, "alpha.txt.gstow-bak")+"\n") {
+		t.Fatalf("unexpected stdout %q", stdout.String())
+	}
+
+	stdout.Reset()
+	code = run(context.Background(), []string{"--on-conflict=ask", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 2 {
+		t.Fatalf("expected exit code 2 for unknown policy, got %d", code)
+	}
+}
+
+func TestRunAdoptDryRun(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	existing := filepath.Join(targetDir, "alpha.txt")
+	mustWriteFile(t, existing)
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "--adopt", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "ADOPT " + filepath.Join(targetAbs, "alpha.txt") + " -> " + filepath.Join(stowDirAbs, "pkg", "alpha.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+	info, err := os.Lstat(existing)
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected target file to remain untouched in dry-run: %v", err)
+	}
+}
+
+func TestRunIgnoreOption(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	mustWriteFile(t, filepath.Join(pkg, "alpha.txt"))
+	mustWriteFile(t, filepath.Join(pkg, "bravo.txt"))
+	mustWriteFile(t, filepath.Join(pkg, "charlie.txt"))
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "--ignore", "bravo\\.txt", "--ignore", "charlie\\.txt", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "LINK " + filepath.Join(targetAbs, "alpha.txt") + " -> " + filepath.Join(stowDirAbs, "pkg", "alpha.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+}
+
+func TestRunAllAndPackagePatterns(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	mustMkdir(t, filepath.Join(stowDir, "pkg-a"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg-a", "alpha.txt"))
+	mustMkdir(t, filepath.Join(stowDir, "pkg-b"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg-b", "bravo.txt"))
+	mustMkdir(t, filepath.Join(stowDir, "other"))
+	mustWriteFile(t, filepath.Join(stowDir, "other", "charlie.txt"))
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	link := func(pkg, name string) string {
+		return "LINK " + filepath.Join(targetAbs, name) + " -> " + filepath.Join(stowDirAbs, pkg, name) + "\n"
+	}
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--all", "--exclude", "pkg-b"}, link("other", "charlie.txt") + link("pkg-a", "alpha.txt")},
+		{[]string{"pkg-*"}, link("pkg-a", "alpha.txt") + link("pkg-b", "bravo.txt")},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-n", "-d", stowDir, "-t", targetDir}, tc.args...)
+		code := run(context.Background(), args, &stdout, &stderr)
+		if code != 0 {
+			t.Fatalf("%q: expected exit code 0, got %d (stderr %q)", tc.args, code, stderr.String())
+		}
+		if stdout.String() != tc.expected {
+			t.Fatalf("%q: stdout mismatch:\n got: %q\nwant: %q", tc.args, stdout.String(), tc.expected)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "-d", stowDir, "-t", targetDir, "nvim*"}, &stdout, &stderr)
+	if code != exitValidation || !strings.Contains(stderr.String(), "no packages match") {
+		t.Fatalf("expected a validation error for an unmatched pattern, got %d (stderr %q)", code, stderr.String())
+	}
+}
+
+func TestRunStatusDriftExitCode(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"status", "-d", stowDir, "-t", targetDir}, &stdout, &stderr)
+	if code != 3 {
+		t.Fatalf("expected exit code 3, got %d (stderr %q)", code, stderr.String())
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "STATUS pkg: not stowed\n" +
+		"MISSING " + filepath.Join(targetAbs, "alpha.txt") + " -> " + filepath.Join(stowDirAbs, "pkg", "alpha.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+
+	stdout.Reset()
+	code = run(context.Background(), []string{"-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Skipf("stow failed (symlinks unsupported?): %q", stderr.String())
+	}
+
+	stdout.Reset()
+	code = run(context.Background(), []string{"status", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+	if stdout.String() != "STATUS pkg: stowed\n" {
+		t.Fatalf("unexpected stdout %q", stdout.String())
+	}
+}
+
+func TestRunPruneOutput(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	mustWriteFile(t, filepath.Join(pkg, "alpha.txt"))
+
+	stale := filepath.Join(targetDir, "gone.txt")
+	if err := os.Symlink(filepath.Join(pkg, "gone.txt"), stale); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"prune", "-d", stowDir, "-t", targetDir}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := "UNLINK " + filepath.Join(targetAbs, "gone.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected stale symlink to be removed, got %v", err)
+	}
+}
+
+func TestRunJSONFormat(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "bravo.txt"))
+	mustWriteFile(t, filepath.Join(targetDir, "bravo.txt"))
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "--format=json", "-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 1 {
+		t.Fatalf("expected exit code 1, got %d (stderr %q)", code, stderr.String())
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("expected empty stderr, got %q", stderr.String())
+	}
+
+	var doc struct {
+		SchemaVersion int    `json:"schema_version"`
+		Dir           string `json:"dir"`
+		Target        string `json:"target"`
+		Operations    []struct {
+			Kind   string `json:"kind"`
+			Source string `json:"source"`
+			Target string `json:"target"`
+		} `json:"operations"`
+		Conflicts []struct {
+			Target string `json:"target"`
+			Reason string `json:"reason"`
+		} `json:"conflicts"`
+		DryRun   bool `json:"dry_run"`
+		ExitCode int  `json:"exit_code"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid JSON %q: %v", stdout.String(), err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	if doc.SchemaVersion != 1 || doc.Dir != stowDirAbs || doc.Target != targetAbs || !doc.DryRun || doc.ExitCode != 1 {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if len(doc.Operations) != 1 || doc.Operations[0].Kind != "LINK" || doc.Operations[0].Target != filepath.Join(targetAbs, "alpha.txt") {
+		t.Fatalf("unexpected operations %+v", doc.Operations)
+	}
+	if len(doc.Conflicts) != 1 || doc.Conflicts[0].Target != filepath.Join(targetAbs, "bravo.txt") {
+		t.Fatalf("unexpected conflicts %+v", doc.Conflicts)
+	}
+}
+
+func TestRunNDJSONFormatReportsErrors(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"--format=ndjson", "-d", stowDir, "-t", targetDir, "missing"}, &stdout, &stderr)
+	if code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+
+	var types []string
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var record struct {
+			SchemaVersion int    `json:"schema_version"`
+			Type          string `json:"type"`
+			Path          string `json:"path"`
+			Message       string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+		if record.SchemaVersion != 1 {
+			t.Fatalf("unexpected schema version in %q", line)
+		}
+		if record.Type == "error" && (record.Path == "" || record.Message == "") {
+			t.Fatalf("incomplete error record %q", line)
+		}
+		types = append(types, record.Type)
+	}
+	if strings.Join(types, ",") != "error,exit" {
+		t.Fatalf("unexpected records %q", stdout.String())
+	}
+}
+
+func TestRunJSONFormatReportsValidationErrors(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"--format=json", "--on-conflict=bogus", "-d", t.TempDir(), "-t", t.TempDir(), "pkg"}, &stdout, &stderr)
+	if code != 2 {
+		t.Fatalf("expected exit code 2, got %d", code)
+	}
+	if stderr.Len() != 0 {
+		t.Fatalf("expected empty stderr, got %q", stderr.String())
+	}
+	var doc struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+		ExitCode int `json:"exit_code"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid JSON %q: %v", stdout.String(), err)
+	}
+	if len(doc.Errors) != 1 || !strings.Contains(doc.Errors[0].Message, "bogus") || doc.ExitCode != 2 {
+		t.Fatalf("unexpected document %q", stdout.String())
+	}
+}
+
+func TestRunUnknownFormat(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"--format=xml", "-d", t.TempDir(), "-t", t.TempDir(), "pkg"}, &stdout, &stderr)
+	if code != 2 || !strings.Contains(stderr.String(), "unknown format") {
+		t.Fatalf("expected format validation error, got %d %q", code, stderr.String())
+	}
+}
+
+func TestRunVerboseLevels(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+
+	targetAbs, _ := filepath.Abs(targetDir)
+	for _, tc := range []struct {
+		args  []string
+		trace bool
+	}{
+		{args: []string{"-v"}},
+		{args: []string{"-v", "-v", "-v"}, trace: true},
+		{args: []string{"--verbose=3"}, trace: true},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := append(append([]string{"-n"}, tc.args...), "-d", stowDir, "-t", targetDir, "pkg")
+		if code := run(context.Background(), args, &stdout, &stderr); code != 0 {
+			t.Fatalf("%v: expected exit code 0, got %d (stderr %q)", tc.args, code, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), "LINK: "+filepath.Join(targetAbs, "alpha.txt")+" => ") {
+			t.Fatalf("%v: expected link message, got %q", tc.args, stderr.String())
+		}
+		if strings.Contains(stderr.String(), "Walking ") != tc.trace {
+			t.Fatalf("%v: unexpected trace output %q", tc.args, stderr.String())
+		}
+	}
+}
+
 func TestRunValidationExitCode(t *testing.T) {
 	stowDir := t.TempDir()
 	targetDir := t.TempDir()
 
 	var stdout, stderr bytes.Buffer
-	code := run([]string{"-d", stowDir, "-t", targetDir}, &stdout, &stderr)
+	code := run(context.Background(), []string{"-d", stowDir, "-t", targetDir}, &stdout, &stderr)
 	if code != 2 {
 		t.Fatalf("expected exit code 2, got %d", code)
 	}
@@ -79,6 +552,26 @@ func TestRunValidationExitCode(t *testing.T) {
 	}
 }
 
+func TestRunInterruptedExitCode(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var stdout, stderr bytes.Buffer
+	code := run(ctx, []string{"-d", stowDir, "-t", targetDir, "pkg"}, &stdout, &stderr)
+	if code != 130 {
+		t.Fatalf("expected exit code 130, got %d", code)
+	}
+	if !strings.Contains(stderr.String(), "context canceled") {
+		t.Fatalf("expected cancellation error, got %q", stderr.String())
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "alpha.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be linked, got %v", err)
+	}
+}
+
 func mustMkdir(t *testing.T, path string) {
 	t.Helper()
 	if err := os.MkdirAll(path, 0o755); err != nil {
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type argKind int
+
+const (
+	noArg argKind = iota
+	requiredArg
+	// optionalArg takes a value only as --name=value, or as digits directly
+	// following a short option (-v2).
+	optionalArg
+)
+
+// option describes one command-line option for parseArgs. Either name may be
+// empty. set receives the value and whether one was given.
+type option struct {
+	long  string
+	short byte
+	arg   argKind
+	set   func(value string, hasValue bool) error
+}
+
+// parseArgs parses args the way GNU getopt_long does: long options as
+// --name, --name=value or --name value, unambiguous prefixes of long names,
+// bundled short options (-nv, -dDIR), and "--" ending option processing.
+// Arguments that are not options are passed to operand in order, interleaved
+// with the options, so that options can change how later operands are treated.
+func parseArgs(options []option, args []string, operand func(string)) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			for _, rest := range args[i+1:] {
+				operand(rest)
+			}
+			return nil
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			opt, err := lookupLong(options, name)
+			if err != nil {
+				return err
+			}
+			switch opt.arg {
+			case noArg:
+				if hasValue {
+					return fmt.Errorf("option '--%s' doesn't allow an argument", opt.long)
+				}
+			case requiredArg:
+				if !hasValue {
+					if i+1 >= len(args) {
+						return fmt.Errorf("option '--%s' requires an argument", opt.long)
+					}
+					i++
+					value, hasValue = args[i], true
+				}
+			}
+			if err := opt.set(value, hasValue); err != nil {
+				return fmt.Errorf("option '--%s': %w", opt.long, err)
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			next, err := parseShort(options, arg[1:], args[i+1:])
+			if err != nil {
+				return err
+			}
+			i += next
+		default:
+			operand(arg)
+		}
+	}
+	return nil
+}
+
+// parseShort parses the bundle of short options in cluster and returns how
+// many of the following arguments it consumed.
+func parseShort(options []option, cluster string, rest []string) (int, error) {
+	for j := 0; j < len(cluster); j++ {
+		opt := lookupShort(options, cluster[j])
+		if opt == nil {
+			return 0, fmt.Errorf("invalid option -- '%c'", cluster[j])
+		}
+		tail := cluster[j+1:]
+		switch opt.arg {
+		case noArg:
+			if err := opt.set("", false); err != nil {
+				return 0, fmt.Errorf("option '-%c': %w", opt.short, err)
+			}
+			continue
+		case requiredArg:
+			consumed := 0
+			if tail == "" {
+				if len(rest) == 0 {
+					return 0, fmt.Errorf("option requires an argument -- '%c'", opt.short)
+				}
+				tail, consumed = rest[0], 1
+			}
+			if err := opt.set(tail, true); err != nil {
+				return 0, fmt.Errorf("option '-%c': %w", opt.short, err)
+			}
+			return consumed, nil
+		case optionalArg:
+			digits := len(tail) - len(strings.TrimLeft(tail, "0123456789"))
+			if err := opt.set(tail[:digits], digits > 0); err != nil {
+				return 0, fmt.Errorf("option '-%c': %w", opt.short, err)
+			}
+			j += digits
+		}
+	}
+	return 0, nil
+}
+
+// lookupLong finds the option named name, or the only option whose long name
+// starts with name.
+func lookupLong(options []option, name string) (*option, error) {
+	var match *option
+	ambiguous := false
+	for i := range options {
+		opt := &options[i]
+		if opt.long == "" {
+			continue
+		}
+		if opt.long == name {
+			return opt, nil
+		}
+		if name != "" && strings.HasPrefix(opt.long, name) {
+			if match != nil {
+				ambiguous = true
+			}
+			match = opt
+		}
+	}
+	switch {
+	case ambiguous:
+		return nil, fmt.Errorf("option '--%s' is ambiguous", name)
+	case match == nil:
+		return nil, fmt.Errorf("unrecognized option '--%s'", name)
+	}
+	return match, nil
+}
+
+func lookupShort(options []option, short byte) *option {
+	for i := range options {
+		if options[i].short == short {
+			return &options[i]
+		}
+	}
+	return nil
+}
+
+// boolOption sets *p when the option is given.
+func boolOption(long string, short byte, p *bool) option {
+	return option{long: long, short: short, set: func(string, bool) error {
+		*p = true
+		return nil
+	}}
+}
+
+// stringOption stores the option's value in *p; the last occurrence wins.
+func stringOption(long string, short byte, p *string) option {
+	return option{long: long, short: short, arg: requiredArg, set: func(value string, _ bool) error {
+		*p = value
+		return nil
+	}}
+}
+
+// listOption appends each occurrence's value to *p.
+func listOption(long string, p *[]string) option {
+	return option{long: long, arg: requiredArg, set: func(value string, _ bool) error {
+		*p = append(*p, value)
+		return nil
+	}}
+}
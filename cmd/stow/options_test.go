@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	var (
+		dryRun, adopt bool
+		dir           string
+		ignore        []string
+		verbose       verbosity
+		events        []string
+	)
+	options := []option{
+		boolOption("no", 'n', &dryRun),
+		boolOption("adopt", 0, &adopt),
+		stringOption("dir", 'd', &dir),
+		stringOption("dotfiles-dir", 0, new(string)),
+		listOption("ignore", &ignore),
+		{long: "verbose", short: 'v', arg: optionalArg, set: verbose.set},
+		{long: "delete", short: 'D', set: func(string, bool) error {
+			events = append(events, "-D")
+			return nil
+		}},
+	}
+	args := []string{"-nvv", "--ad", "a", "-D", "b", "--ignore=x", "--ignore", "y", "-dstow", "--verbose=5", "--", "-c"}
+	if err := parseArgs(options, args, func(arg string) { events = append(events, arg) }); err != nil {
+		t.Fatalf("parseArgs error: %v", err)
+	}
+	if !dryRun || !adopt || dir != "stow" || verbose != 5 {
+		t.Fatalf("unexpected values: n=%v adopt=%v dir=%q verbose=%d", dryRun, adopt, dir, verbose)
+	}
+	if !reflect.DeepEqual(ignore, []string{"x", "y"}) {
+		t.Fatalf("unexpected ignore %q", ignore)
+	}
+	if !reflect.DeepEqual(events, []string{"a", "-D", "b", "-c"}) {
+		t.Fatalf("unexpected operand order %q", events)
+	}
+
+	verbose = 0
+	if err := parseArgs(options, []string{"-v2n", "-d", "other"}, func(string) {}); err != nil {
+		t.Fatalf("parseArgs error: %v", err)
+	}
+	if verbose != 2 || dir != "other" {
+		t.Fatalf("unexpected values: verbose=%d dir=%q", verbose, dir)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--bogus"}, want: "unrecognized option '--bogus'"},
+		{args: []string{"--d"}, want: "option '--d' is ambiguous"},
+		{args: []string{"--no=1"}, want: "option '--no' doesn't allow an argument"},
+		{args: []string{"--dir"}, want: "option '--dir' requires an argument"},
+		{args: []string{"-nd"}, want: "option requires an argument -- 'd'"},
+		{args: []string{"-x"}, want: "invalid option -- 'x'"},
+		{args: []string{"--verbose=high"}, want: "invalid verbosity"},
+	} {
+		err := parseArgs(options, tc.args, func(string) {})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("parseArgs(%q) error = %v, want %q", tc.args, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/beppler/gstow/stow"
+)
+
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// schemaVersion is the version of the json and ndjson output schema. It
+// changes only when a field is removed or its meaning changes.
+const schemaVersion = 1
+
+// reporter writes the results of a command in one output format. close is
+// called exactly once, after everything else, with the exit code.
+type reporter interface {
+	plan(plan stow.Plan)
+	operation(op stow.Operation)
+	conflict(conflict stow.Conflict)
+	status(status stow.PackageStatus)
+	error(path string, err error)
+	executed(dryRun bool)
+	close(code int)
+}
+
+func newReporter(format string, stdout, stderr io.Writer) (reporter, error) {
+	switch format {
+	case formatText:
+		return &textReporter{stdout: stdout, stderr: stderr}, nil
+	case formatJSON:
+		return &jsonReporter{w: stdout, doc: newJSONDocument()}, nil
+	case formatNDJSON:
+		return &ndjsonReporter{enc: json.NewEncoder(stdout)}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q (want text, json or ndjson)", format)
+	}
+}
+
+// textReporter writes operations and status lines to stdout and conflicts and
+// errors to stderr.
+type textReporter struct {
+	stdout, stderr io.Writer
+}
+
+func (r *textReporter) plan(stow.Plan) {}
+
+func (r *textReporter) operation(op stow.Operation) {
+	writeOperation(r.stdout, op)
+}
+
+func (r *textReporter) conflict(conflict stow.Conflict) {
+	writeConflict(r.stderr, conflict)
+}
+
+func (r *textReporter) status(status stow.PackageStatus) {
+	fmt.Fprintf(r.stdout, "STATUS %s: %s\n", status.Package, status.Status)
+	for _, op := range status.Missing {
+		fmt.Fprintf(r.stdout, "MISSING %s -> %s\n", op.Target, op.Source)
+	}
+	for _, op := range status.Extra {
+		fmt.Fprintf(r.stdout, "EXTRA %s -> %s\n", op.Target, op.Source)
+	}
+	for _, conflict := range status.Conflicts {
+		r.conflict(conflict)
+	}
+}
+
+func (r *textReporter) error(path string, err error) {
+	writeError(r.stderr, path, err)
+}
+
+func (r *textReporter) executed(bool) {}
+
+func (r *textReporter) close(int) {}
+
+type jsonOperation struct {
+	Kind   string `json:"kind"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type jsonConflict struct {
+	Target   string `json:"target"`
+	Reason   string `json:"reason"`
+	Kind     string `json:"kind"`
+	Existing string `json:"existing"`
+	LinkDest string `json:"link_destination,omitempty"`
+	Package  string `json:"package,omitempty"`
+}
+
+type jsonStatus struct {
+	Package   string          `json:"package"`
+	Status    string          `json:"status"`
+	Missing   []jsonOperation `json:"missing"`
+	Extra     []jsonOperation `json:"extra"`
+	Conflicts []jsonConflict  `json:"conflicts"`
+}
+
+type jsonError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type jsonPlan struct {
+	Dir    string `json:"dir"`
+	Target string `json:"target"`
+}
+
+type jsonResult struct {
+	Executed bool `json:"executed"`
+	DryRun   bool `json:"dry_run"`
+}
+
+func toJSONOperation(op stow.Operation) jsonOperation {
+	return jsonOperation{Kind: op.Kind.String(), Source: op.Source, Target: op.Target}
+}
+
+func toJSONConflict(conflict stow.Conflict) jsonConflict {
+	return jsonConflict{
+		Target:   conflict.Target,
+		Reason:   conflict.Reason,
+		Kind:     conflict.Kind.String(),
+		Existing: conflict.Existing.String(),
+		LinkDest: conflict.LinkDest,
+		Package:  conflict.Package,
+	}
+}
+
+func toJSONOperations(ops []stow.Operation) []jsonOperation {
+	out := make([]jsonOperation, 0, len(ops))
+	for _, op := range ops {
+		out = append(out, toJSONOperation(op))
+	}
+	return out
+}
+
+func toJSONStatus(status stow.PackageStatus) jsonStatus {
+	out := jsonStatus{
+		Package:   status.Package,
+		Status:    status.Status.String(),
+		Missing:   toJSONOperations(status.Missing),
+		Extra:     toJSONOperations(status.Extra),
+		Conflicts: make([]jsonConflict, 0, len(status.Conflicts)),
+	}
+	for _, conflict := range status.Conflicts {
+		out.Conflicts = append(out.Conflicts, toJSONConflict(conflict))
+	}
+	return out
+}
+
+func toJSONError(path string, err error) jsonError {
+	return jsonError{Path: path, Message: err.Error()}
+}
+
+// jsonDocument is the single object written by --format=json.
+type jsonDocument struct {
+	SchemaVersion int `json:"schema_version"`
+	*jsonPlan
+	Operations []jsonOperation `json:"operations"`
+	Conflicts  []jsonConflict  `json:"conflicts"`
+	Statuses   []jsonStatus    `json:"statuses,omitempty"`
+	jsonResult
+	Errors   []jsonError `json:"errors"`
+	ExitCode int         `json:"exit_code"`
+}
+
+func newJSONDocument() *jsonDocument {
+	return &jsonDocument{
+		SchemaVersion: schemaVersion,
+		Operations:    []jsonOperation{},
+		Conflicts:     []jsonConflict{},
+		Errors:        []jsonError{},
+	}
+}
+
+// jsonReporter collects everything and writes one JSON document on close.
+type jsonReporter struct {
+	w   io.Writer
+	doc *jsonDocument
+}
+
+func (r *jsonReporter) plan(plan stow.Plan) {
+	r.doc.jsonPlan = &jsonPlan{Dir: plan.Dir, Target: plan.Target}
+}
+
+func (r *jsonReporter) operation(op stow.Operation) {
+	r.doc.Operations = append(r.doc.Operations, toJSONOperation(op))
+}
+
+func (r *jsonReporter) conflict(conflict stow.Conflict) {
+	r.doc.Conflicts = append(r.doc.Conflicts, toJSONConflict(conflict))
+}
+
+func (r *jsonReporter) status(status stow.PackageStatus) {
+	r.doc.Statuses = append(r.doc.Statuses, toJSONStatus(status))
+}
+
+func (r *jsonReporter) error(path string, err error) {
+	r.doc.Errors = append(r.doc.Errors, toJSONError(path, err))
+}
+
+func (r *jsonReporter) executed(dryRun bool) {
+	r.doc.jsonResult = jsonResult{Executed: !dryRun, DryRun: dryRun}
+}
+
+func (r *jsonReporter) close(code int) {
+	r.doc.ExitCode = code
+	enc := json.NewEncoder(r.w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(r.doc)
+}
+
+// recordHeader starts every ndjson record.
+type recordHeader struct {
+	SchemaVersion int    `json:"schema_version"`
+	Type          string `json:"type"`
+}
+
+// ndjsonReporter writes one JSON record per line as events happen.
+type ndjsonReporter struct {
+	enc *json.Encoder
+}
+
+func (r *ndjsonReporter) header(recordType string) recordHeader {
+	return recordHeader{SchemaVersion: schemaVersion, Type: recordType}
+}
+
+func (r *ndjsonReporter) plan(plan stow.Plan) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		jsonPlan
+	}{r.header("plan"), jsonPlan{Dir: plan.Dir, Target: plan.Target}})
+}
+
+func (r *ndjsonReporter) operation(op stow.Operation) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		jsonOperation
+	}{r.header("operation"), toJSONOperation(op)})
+}
+
+func (r *ndjsonReporter) conflict(conflict stow.Conflict) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		jsonConflict
+	}{r.header("conflict"), toJSONConflict(conflict)})
+}
+
+func (r *ndjsonReporter) status(status stow.PackageStatus) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		jsonStatus
+	}{r.header("status"), toJSONStatus(status)})
+}
+
+func (r *ndjsonReporter) error(path string, err error) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		jsonError
+	}{r.header("error"), toJSONError(path, err)})
+}
+
+func (r *ndjsonReporter) executed(dryRun bool) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		jsonResult
+	}{r.header("result"), jsonResult{Executed: !dryRun, DryRun: dryRun}})
+}
+
+func (r *ndjsonReporter) close(code int) {
+	_ = r.enc.Encode(struct {
+		recordHeader
+		ExitCode int `json:"exit_code"`
+	}{r.header("exit"), code})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/beppler/gstow/stow"
+)
+
+// stowrcFile is the name of the resource file holding default options, read
+// from the home directory and then from the current directory.
+const stowrcFile = ".stowrc"
+
+// loadStowrcFiles returns the options of ~/.stowrc followed by those of
+// ./.stowrc, so that the current directory's file takes precedence.
+func loadStowrcFiles() ([]string, error) {
+	var paths []string
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, stowrcFile))
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		paths = append(paths, filepath.Join(cwd, stowrcFile))
+	}
+	return loadStowrc(paths...)
+}
+
+// loadStowrc reads the resource files that exist among paths, skipping a file
+// listed twice, and returns their options in order.
+func loadStowrc(paths ...string) ([]string, error) {
+	var args []string
+	seen := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		if _, dup := seen[path]; dup {
+			continue
+		}
+		seen[path] = struct{}{}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, &stow.PathError{Path: path, Err: err}
+		}
+		words, err := splitWords(string(data))
+		if err != nil {
+			return nil, &stow.PathError{Path: path, Err: err}
+		}
+		args = append(args, expandDirOptions(words)...)
+	}
+	return args, nil
+}
+
+// splitWords splits s into words the way a POSIX shell would, without
+// expansion: words are separated by blanks, single quotes preserve their
+// content literally, double quotes allow backslash escapes of `"`, `\`, `$`
+// and "`", and an unquoted backslash escapes the next character. A `#` at the
+// start of a word begins a comment running to the end of the line.
+func splitWords(s string) ([]string, error) {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '#' && !inWord:
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				if s[i] != '\n' {
+					word.WriteByte(s[i])
+					inWord = true
+				}
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// expandDirOptions expands a leading ~ and $VAR references in the values of
+// the -d/--dir and -t/--target options, given as "--dir=value", "--dir value",
+// "-dvalue" or "-d value".
+func expandDirOptions(words []string) []string {
+	out := make([]string, len(words))
+	copy(out, words)
+	for i := 0; i < len(out); i++ {
+		word := out[i]
+		prefix, value := "", ""
+		switch {
+		case word == "--dir" || word == "--target" || word == "-d" || word == "-t":
+			if i+1 < len(out) {
+				i++
+				out[i] = expandPath(out[i])
+			}
+			continue
+		case strings.HasPrefix(word, "--dir=") || strings.HasPrefix(word, "--target="):
+			prefix, value, _ = strings.Cut(word, "=")
+			prefix += "="
+		case strings.HasPrefix(word, "-") && !strings.HasPrefix(word, "--"):
+			// A short option cluster such as -nvt~/target.
+			j := strings.IndexAny(word[1:], "dt")
+			if j < 0 {
+				continue
+			}
+			prefix, value = word[:j+2], word[j+2:]
+			if value == "" {
+				if i+1 < len(out) {
+					i++
+					out[i] = expandPath(out[i])
+				}
+				continue
+			}
+		default:
+			continue
+		}
+		out[i] = prefix + expandPath(value)
+	}
+	return out
+}
+
+// expandPath replaces a leading ~ with the home directory and expands $VAR
+// and ${VAR} references from the environment.
+func expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + path[1:]
+		}
+	}
+	return os.ExpandEnv(path)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	cases := []struct {
+		input string
+		want  []string
+	}{
+		{input: "-v --dir=stow\n--ignore '\\.orig$'\n", want: []string{"-v", "--dir=stow", "--ignore", `\.orig$`}},
+		{input: `--target="$HOME/my dir" a\ b`, want: []string{"--target=$HOME/my dir", "a b"}},
+		{input: `"say \"hi\"" 'it''s'`, want: []string{`say "hi"`, "its"}},
+		{input: "# comment\n--adopt # trailing\n--ignore=a#b", want: []string{"--adopt", "--ignore=a#b"}},
+		{input: "  \n\t", want: nil},
+	}
+	for _, tc := range cases {
+		got, err := splitWords(tc.input)
+		if err != nil {
+			t.Fatalf("splitWords(%q) error: %v", tc.input, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("splitWords(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+
+	for _, input := range []string{"'open", `"open`} {
+		if _, err := splitWords(input); err == nil {
+			t.Fatalf("splitWords(%q) expected error", input)
+		}
+	}
+}
+
+func TestExpandDirOptions(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("STOW_TEST_DIR", "/srv/stow")
+
+	got := expandDirOptions([]string{"--dir=$STOW_TEST_DIR", "-t", "~/target", "--ignore=$X", "~", "-nd${STOW_TEST_DIR}/x", "--target", "~"})
+	want := []string{"--dir=/srv/stow", "-t", home + "/target", "--ignore=$X", "~", "-nd/srv/stow/x", "--target", home}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expandDirOptions = %q, want %q", got, want)
+	}
+}
+
+func TestRunReadsStowrc(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	stowDir := filepath.Join(home, "dotfiles")
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt.orig"))
+	mustMkdir(t, filepath.Join(home, "target"))
+	rc := "--dir=~/dotfiles\n--target $HOME/target\n--ignore='\\.orig'\n"
+	if err := os.WriteFile(filepath.Join(home, stowrcFile), []byte(rc), 0o644); err != nil {
+		t.Fatalf("write .stowrc: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-n", "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+	expected := "LINK " + filepath.Join(home, "target", "alpha.txt") + " -> " + filepath.Join(stowDir, "pkg", "alpha.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+
+	// Command-line options take precedence over the resource file.
+	other := t.TempDir()
+	stdout.Reset()
+	code = run(context.Background(), []string{"-n", "-t", other, "pkg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr %q)", code, stderr.String())
+	}
+	expected = "LINK " + filepath.Join(other, "alpha.txt") + " -> " + filepath.Join(stowDir, "pkg", "alpha.txt") + "\n"
+	if stdout.String() != expected {
+		t.Fatalf("stdout mismatch:\n got: %q\nwant: %q", stdout.String(), expected)
+	}
+}
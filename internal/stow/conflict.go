@@ -0,0 +1,132 @@
+package stow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ConflictKind classifies a Conflict.
+type ConflictKind int
+
+const (
+	// ConflictTargetExists means a file or directory that is not a symlink
+	// occupies the target of a package entry being stowed.
+	ConflictTargetExists ConflictKind = iota
+	// ConflictLinkElsewhere means the target is a symlink that does not
+	// point to the package entry.
+	ConflictLinkElsewhere
+	// ConflictNotSymlink means a target being unstowed is not a symlink.
+	ConflictNotSymlink
+	// ConflictDuplicateTarget means two packages in the run provide the
+	// same target.
+	ConflictDuplicateTarget
+)
+
+// String returns a stable identifier for the kind.
+func (k ConflictKind) String() string {
+	switch k {
+	case ConflictTargetExists:
+		return "exists"
+	case ConflictLinkElsewhere:
+		return "link-elsewhere"
+	case ConflictNotSymlink:
+		return "not-symlink"
+	case ConflictDuplicateTarget:
+		return "duplicate"
+	default:
+		return fmt.Sprintf("ConflictKind(%d)", int(k))
+	}
+}
+
+// reason returns the human-readable description used as Conflict.Reason.
+func (k ConflictKind) reason() string {
+	switch k {
+	case ConflictTargetExists:
+		return "target already exists"
+	case ConflictLinkElsewhere:
+		return "symlink points elsewhere"
+	case ConflictNotSymlink:
+		return "target is not a symlink"
+	case ConflictDuplicateTarget:
+		return "duplicate target planned"
+	default:
+		return k.String()
+	}
+}
+
+// FileType is the type of the file found at a conflicting target.
+type FileType int
+
+const (
+	// FileNone means nothing exists at the target.
+	FileNone FileType = iota
+	// FileRegular is a regular file.
+	FileRegular
+	// FileDirectory is a real directory.
+	FileDirectory
+	// FileSymlink is a symlink, whatever it points to.
+	FileSymlink
+	// FileOther covers devices, sockets, named pipes and the like.
+	FileOther
+)
+
+func (t FileType) String() string {
+	switch t {
+	case FileNone:
+		return "none"
+	case FileRegular:
+		return "file"
+	case FileDirectory:
+		return "directory"
+	case FileSymlink:
+		return "symlink"
+	case FileOther:
+		return "other"
+	default:
+		return fmt.Sprintf("FileType(%d)", int(t))
+	}
+}
+
+func fileTypeOf(mode os.FileMode) FileType {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return FileSymlink
+	case mode.IsDir():
+		return FileDirectory
+	case mode.IsRegular():
+		return FileRegular
+	default:
+		return FileOther
+	}
+}
+
+// describeConflict builds the Conflict of the given kind for targetPath,
+// recording what exists there once planned removals and unfolds are applied
+// and, when it links into the stow directory or is already planned, the
+// package that owns it. Details that cannot be read are left empty.
+func (s *planState) describeConflict(targetPath string, kind ConflictKind) Conflict {
+	conflict := Conflict{Target: targetPath, Reason: kind.reason(), Kind: kind}
+	if info, err := s.lstatTarget(targetPath); err == nil {
+		conflict.Existing = fileTypeOf(info.Mode())
+		if conflict.Existing == FileSymlink {
+			if dest, err := s.linkDestination(targetPath); err == nil {
+				conflict.LinkDest = dest
+				if s.owns(dest) {
+					conflict.Package = s.packageName(dest)
+				}
+			}
+		}
+	}
+	if kind == ConflictDuplicateTarget {
+		if i, planned := s.linkIndex[targetPath]; planned {
+			conflict.Package = s.packageName(s.result.Operations[i].Source)
+		}
+	}
+	return conflict
+}
+
+// packageName returns the name of the package containing the owned path.
+func (s *planState) packageName(path string) string {
+	return filepath.Base(s.packageRoot(path))
+}
@@ -0,0 +1,92 @@
+package stow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildPlanDescribesConflicts(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(stowDir, "alpha", "shared.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "bravo", "shared.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "bravo", "owned.txt"))
+	other := filepath.Join(stowDir, "other", "owned.txt")
+	mustWriteFile(t, other)
+	mustWriteFile(t, filepath.Join(stowDir, "bravo", "dir", "file.txt"))
+	mustMkdir(t, filepath.Join(targetDir, "dir", "file.txt"))
+
+	if !symlinkSupported(t, t.TempDir()) {
+		return
+	}
+	if err := os.Symlink(other, filepath.Join(targetDir, "owned.txt")); err != nil {
+		t.Fatalf("symlink failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"alpha", "bravo"}})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	expected := []Conflict{
+		{
+			Target:   filepath.Join(targetDir, "dir", "file.txt"),
+			Reason:   "target already exists",
+			Kind:     ConflictTargetExists,
+			Existing: FileDirectory,
+		},
+		{
+			Target:   filepath.Join(targetDir, "owned.txt"),
+			Reason:   "symlink points elsewhere",
+			Kind:     ConflictLinkElsewhere,
+			Existing: FileSymlink,
+			LinkDest: other,
+			Package:  "other",
+		},
+		{
+			Target:  filepath.Join(targetDir, "shared.txt"),
+			Reason:  "duplicate target planned",
+			Kind:    ConflictDuplicateTarget,
+			Package: "alpha",
+		},
+	}
+	if len(plan.Conflicts) != len(expected) {
+		t.Fatalf("expected %d conflicts, got %+v", len(expected), plan.Conflicts)
+	}
+	for i, conflict := range plan.Conflicts {
+		if conflict != expected[i] {
+			t.Fatalf("conflict %d mismatch:\n got %+v\nwant %+v", i, conflict, expected[i])
+		}
+	}
+}
+
+func TestBuildPlanDescribesConflictsBelowUnfoldedDirectory(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "base", "config", "shared.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "alpha", "config", "shared.txt"))
+	if err := m.MkdirAll(targetDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	if err := m.Symlink(filepath.Join("..", "stow", "base", "config"), filepath.Join(targetDir, "config")); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"alpha"}, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	// The package's own file seen through the folded link is not a file at
+	// the target: the link is planned to become a directory.
+	expected := Conflict{
+		Target:   filepath.Join(targetDir, "config", "shared.txt"),
+		Reason:   "duplicate target planned",
+		Kind:     ConflictDuplicateTarget,
+		Existing: FileNone,
+		Package:  "base",
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0] != expected {
+		t.Fatalf("unexpected conflicts:\n got %+v\nwant %+v", plan.Conflicts, expected)
+	}
+}
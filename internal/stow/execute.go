@@ -1,20 +1,34 @@
 package stow
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 // ExecuteOptions controls execution behavior.
 type ExecuteOptions struct {
 	DryRun bool
+	// Absolute creates links holding the absolute source path instead of a
+	// path relative to the link's directory.
+	Absolute bool
+	// Logger, when set, receives each operation at LevelOps, in execution
+	// order, including during a dry run.
+	Logger Logger
+	// FS is the filesystem changed. Nil means OSFS.
+	FS FS
 }
 
 // OpError provides context for execution failures.
 type OpError struct {
 	Target string
 	Err    error
+	// Applied lists, in execution order, the operations whose changes could
+	// not all be undone. It is empty when the rollback succeeded.
+	Applied []Operation
 }
 
 func (e *OpError) Error() string {
@@ -26,18 +40,280 @@ func (e *OpError) Unwrap() error {
 }
 
 // Execute applies planned operations. When DryRun is true, it makes no filesystem changes.
+// If an operation fails, every change already made is undone in reverse order
+// before the OpError for the failed operation is returned.
+//
+// For plans built by BuildPlan, Execute also records the links and directories
+// it creates or removes, per package, in the StateFile of the target directory.
 func Execute(plan PlanResult, opts ExecuteOptions) error {
+	return ExecuteContext(context.Background(), plan, opts)
+}
+
+// ExecuteContext is Execute with cancellation, checked before each
+// operation. A cancelled execution is rolled back like a failed one: the
+// OpError names the operation that was not started, wraps ctx.Err(), and
+// lists in Applied any operation the rollback could not undo.
+func ExecuteContext(ctx context.Context, plan PlanResult, opts ExecuteOptions) error {
 	if opts.DryRun {
+		for _, op := range executionOrder(plan.Operations) {
+			logOperation(opts.Logger, op)
+		}
+		return nil
+	}
+	if len(plan.Operations) == 0 {
 		return nil
 	}
-	for _, op := range plan.Operations {
-		parent := filepath.Dir(op.Target)
-		if err := os.MkdirAll(parent, 0o755); err != nil {
-			return &OpError{Target: op.Target, Err: err}
+	fsys := orOS(opts.FS)
+	var state *State
+	if plan.Target != "" {
+		var err error
+		if state, err = loadState(fsys, plan.Target); err != nil {
+			return &OpError{Target: filepath.Join(plan.Target, StateFile), Err: err}
 		}
-		if err := os.Symlink(op.Source, op.Target); err != nil {
-			return &OpError{Target: op.Target, Err: err}
+	}
+
+	j := &journal{}
+	for _, op := range executionOrder(plan.Operations) {
+		if err := ctx.Err(); err != nil {
+			return rollback(j, op.Target, err)
+		}
+		logOperation(opts.Logger, op)
+		j.begin(op)
+		created, err := apply(fsys, op, opts, j)
+		if err != nil {
+			return rollback(j, op.Target, err)
+		}
+		if state != nil {
+			state.record(plan, op, created)
 		}
 	}
+	if state != nil {
+		if err := state.save(fsys, plan.Target); err != nil {
+			return rollback(j, filepath.Join(plan.Target, StateFile), err)
+		}
+	}
+	j.commit()
 	return nil
 }
+
+func rollback(j *journal, target string, err error) error {
+	applied, rerr := j.rollback()
+	if rerr != nil {
+		err = errors.Join(err, fmt.Errorf("rollback failed: %w", rerr))
+	}
+	return &OpError{Target: target, Err: err, Applied: applied}
+}
+
+// apply performs op and returns the directories it created.
+func apply(fsys FS, op Operation, opts ExecuteOptions, j *journal) ([]string, error) {
+	switch op.Kind {
+	case OpLink:
+		created, err := mkdirAll(fsys, filepath.Dir(op.Target), j)
+		if err != nil {
+			return nil, err
+		}
+		return created, symlink(fsys, linkText(fsys, op, opts.Absolute), op.Target, j)
+	case OpUnlink:
+		dest, err := fsys.Readlink(op.Target)
+		if err != nil {
+			return nil, err
+		}
+		if err := fsys.Remove(op.Target); err != nil {
+			return nil, err
+		}
+		j.record(func() error { return fsys.Symlink(dest, op.Target) })
+		return nil, nil
+	case OpRmdir:
+		info, err := fsys.Lstat(op.Target)
+		if err != nil {
+			return nil, err
+		}
+		if err := fsys.Remove(op.Target); err != nil {
+			return nil, err
+		}
+		j.record(func() error { return fsys.Mkdir(op.Target, info.Mode().Perm()) })
+		return nil, nil
+	case OpMkdir:
+		if err := fsys.Mkdir(op.Target, 0o755); err != nil {
+			return nil, err
+		}
+		j.record(func() error { return fsys.Remove(op.Target) })
+		return []string{op.Target}, nil
+	case OpAdopt:
+		return nil, adopt(fsys, op, opts, j)
+	case OpBackup:
+		created, err := mkdirAll(fsys, filepath.Dir(op.Source), j)
+		if err != nil {
+			return nil, err
+		}
+		return created, move(fsys, op.Target, op.Source, j)
+	case OpRemove:
+		return nil, removeTree(fsys, op.Target, j)
+	default:
+		return nil, fmt.Errorf("unknown operation %v", op.Kind)
+	}
+}
+
+// mkdirAll creates dir and any missing parents, journaling each directory it
+// creates. It returns the created directories, outermost first.
+func mkdirAll(fsys FS, dir string, j *journal) ([]string, error) {
+	if _, err := fsys.Stat(dir); err == nil {
+		return nil, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var created []string
+	if parent := filepath.Dir(dir); parent != dir {
+		var err error
+		if created, err = mkdirAll(fsys, parent, j); err != nil {
+			return nil, err
+		}
+	}
+	if err := fsys.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	j.record(func() error { return fsys.Remove(dir) })
+	return append(created, dir), nil
+}
+
+func symlink(fsys FS, dest, target string, j *journal) error {
+	if err := fsys.Symlink(dest, target); err != nil {
+		return err
+	}
+	j.record(func() error { return fsys.Remove(target) })
+	return nil
+}
+
+// adopt moves the target file into the package and links it. The package copy
+// is set aside first so that a rollback can restore both files; it is deleted
+// once the whole execution succeeds.
+func adopt(fsys FS, op Operation, opts ExecuteOptions, j *journal) error {
+	backupPath, err := tempName(fsys, filepath.Dir(op.Source), "."+filepath.Base(op.Source)+".*.gstow")
+	if err != nil {
+		return err
+	}
+	if err := fsys.Rename(op.Source, backupPath); err != nil {
+		return err
+	}
+	j.record(func() error { return fsys.Rename(backupPath, op.Source) })
+	j.onCommit(func() error { return fsys.Remove(backupPath) })
+
+	if err := moveFile(fsys, op.Target, op.Source); err != nil {
+		return err
+	}
+	j.record(func() error { return moveFile(fsys, op.Source, op.Target) })
+
+	return symlink(fsys, linkText(fsys, op, opts.Absolute), op.Target, j)
+}
+
+// move renames src to dst, journaling the reverse rename.
+func move(fsys FS, src, dst string, j *journal) error {
+	if _, err := fsys.Lstat(dst); err == nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: os.ErrExist}
+	}
+	if err := fsys.Rename(src, dst); err != nil {
+		return err
+	}
+	j.record(func() error { return fsys.Rename(dst, src) })
+	return nil
+}
+
+// removeTree deletes path, which may be a directory tree. It is first moved into
+// a temporary directory beside it, so a rollback can put it back, and only
+// deleted once the whole execution succeeds.
+func removeTree(fsys FS, path string, j *journal) error {
+	tmp, err := tempName(fsys, filepath.Dir(path), "."+filepath.Base(path)+".*.gstow")
+	if err != nil {
+		return err
+	}
+	if err := fsys.Mkdir(tmp, 0o700); err != nil {
+		return err
+	}
+	held := filepath.Join(tmp, filepath.Base(path))
+	if err := fsys.Rename(path, held); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	j.record(func() error {
+		if err := fsys.Rename(held, path); err != nil {
+			return err
+		}
+		return fsys.Remove(tmp)
+	})
+	j.onCommit(func() error { return fsys.RemoveAll(tmp) })
+	return nil
+}
+
+// moveFile moves the regular file src to dst, replacing dst. It falls back to
+// copying when a rename is not possible, such as across filesystems.
+func moveFile(fsys FS, src, dst string) error {
+	if err := fsys.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(fsys, src, dst); err != nil {
+		return err
+	}
+	return fsys.Remove(src)
+}
+
+func copyFile(fsys FS, src, dst string) error {
+	info, err := fsys.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := fsys.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := fsys.WriteFile(dst, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return fsys.Chmod(dst, info.Mode().Perm())
+}
+
+// linkText returns the path stored in the symlink created for op: the source
+// relative to the link's directory, or the absolute source when requested or
+// when no relative path exists (such as across Windows volumes). The relative
+// path is computed between the resolved directories, so it stays valid when
+// the link's directory is reached through a symlink; when they cannot be
+// resolved the absolute source is used.
+func linkText(fsys FS, op Operation, absolute bool) string {
+	if absolute {
+		return op.Source
+	}
+	dir, err := evalSymlinks(fsys, filepath.Dir(op.Target))
+	if err != nil {
+		return op.Source
+	}
+	rel, err := filepath.Rel(dir, evalParents(fsys, op.Source))
+	if err != nil {
+		return op.Source
+	}
+	return rel
+}
+
+// executionOrder returns the operations ordered so that removals happen before
+// creations: unlinks, backups and removals, then directory removals, then
+// directory creations, then links. The planned order is kept within each
+// group, which places nested directory removals before their parents and
+// creations after them.
+func executionOrder(ops []Operation) []Operation {
+	ordered := append([]Operation(nil), ops...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return phase(ordered[i].Kind) < phase(ordered[j].Kind)
+	})
+	return ordered
+}
+
+func phase(kind OpKind) int {
+	switch kind {
+	case OpUnlink, OpBackup, OpRemove:
+		return 0
+	case OpRmdir:
+		return 1
+	case OpMkdir:
+		return 2
+	default:
+		return 3
+	}
+}
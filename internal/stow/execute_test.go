@@ -1,6 +1,8 @@
 package stow
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -36,7 +38,7 @@ func TestExecuteCreatesSymlink(t *testing.T) {
 	if _, err := os.Lstat(linked); err != nil {
 		t.Fatalf("expected symlink at %s: %v", linked, err)
 	}
-	matches, err := symlinkMatches(linked, source)
+	matches, err := symlinkMatches(OSFS{}, linked, source)
 	if err != nil {
 		t.Fatalf("symlinkMatches error: %v", err)
 	}
@@ -45,6 +47,107 @@ func TestExecuteCreatesSymlink(t *testing.T) {
 	}
 }
 
+func TestExecuteLinkForms(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		absolute bool
+	}{
+		{name: "relative", absolute: false},
+		{name: "absolute", absolute: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stowDir := t.TempDir()
+			targetDir := t.TempDir()
+
+			pkg := filepath.Join(stowDir, "pkg")
+			source := filepath.Join(pkg, "nested", "alpha.txt")
+			mustWriteFile(t, source)
+
+			if !symlinkSupported(t, stowDir) {
+				return
+			}
+
+			plan, err := BuildPlan(Options{
+				Dir:       stowDir,
+				Target:    targetDir,
+				Packages:  []string{"pkg"},
+				NoFolding: true,
+			})
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			if err := Execute(plan, ExecuteOptions{Absolute: tc.absolute}); err != nil {
+				t.Fatalf("Execute error: %v", err)
+			}
+
+			linked := filepath.Join(targetDir, "nested", "alpha.txt")
+			dest, err := os.Readlink(linked)
+			if err != nil {
+				t.Fatalf("readlink %s: %v", linked, err)
+			}
+			if filepath.IsAbs(dest) != tc.absolute {
+				t.Fatalf("unexpected link form %q", dest)
+			}
+			if _, err := os.Stat(linked); err != nil {
+				t.Fatalf("expected link to resolve: %v", err)
+			}
+			matches, err := symlinkMatches(OSFS{}, linked, source)
+			if err != nil {
+				t.Fatalf("symlinkMatches error: %v", err)
+			}
+			if !matches {
+				t.Fatalf("expected symlink to match source")
+			}
+		})
+	}
+}
+
+func TestExecuteRelativeLinkThroughSymlinkedDirectory(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "bravo.txt"))
+	if err := m.MkdirAll(memPath("x/y/z/home"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	// The target sits at a different depth than the path used to reach it.
+	if err := m.Symlink(filepath.Join("x", "y", "z", "home"), targetDir); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	// A link that matches only lexically: it resolves below x/y/z.
+	bravo := filepath.Join(targetDir, "bravo.txt")
+	if err := m.Symlink(filepath.Join("..", "stow", "pkg", "bravo.txt"), bravo); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	if matches, err := symlinkMatches(m, bravo, filepath.Join(stowDir, "pkg", "bravo.txt")); err != nil || matches {
+		t.Fatalf("expected the dangling link not to match, got %v, %v", matches, err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(plan, ExecuteOptions{FS: m}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	alpha := filepath.Join(targetDir, "alpha.txt")
+	if data, err := m.ReadFile(alpha); err != nil || string(data) != "data" {
+		t.Fatalf("expected %s to lead to the package file, got %q, %v", alpha, data, err)
+	}
+	if matches, err := symlinkMatches(m, alpha, filepath.Join(stowDir, "pkg", "alpha.txt")); err != nil || !matches {
+		t.Fatalf("expected the new link to match, got %v, %v", matches, err)
+	}
+
+	statuses, err := Status(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, FS: m})
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Status == StatusStowed {
+		t.Fatalf("expected the dangling bravo.txt link to keep pkg from being stowed, got %+v", statuses)
+	}
+}
+
 func TestExecuteDryRunSkipsChanges(t *testing.T) {
 	stowDir := t.TempDir()
 	pkg := filepath.Join(stowDir, "pkg")
@@ -118,9 +221,10 @@ func TestExecuteCreatesParentDirectories(t *testing.T) {
 	}
 
 	plan, err := BuildPlan(Options{
-		Dir:      stowDir,
-		Target:   targetDir,
-		Packages: []string{"pkg"},
+		Dir:       stowDir,
+		Target:    targetDir,
+		Packages:  []string{"pkg"},
+		NoFolding: true,
 	})
 	if err != nil {
 		t.Fatalf("BuildPlan error: %v", err)
@@ -135,3 +239,327 @@ func TestExecuteCreatesParentDirectories(t *testing.T) {
 		t.Fatalf("expected parent directory to exist: %v", err)
 	}
 }
+
+func TestExecuteCreatesFoldedDirectoryLink(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "nested", "alpha.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	if err := Execute(plan, ExecuteOptions{DryRun: false}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	folded := filepath.Join(targetDir, "nested")
+	info, err := os.Lstat(folded)
+	if err != nil {
+		t.Fatalf("expected folded link at %s: %v", folded, err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected %s to be a symlink", folded)
+	}
+	if _, err := os.Stat(filepath.Join(folded, "alpha.txt")); err != nil {
+		t.Fatalf("expected file reachable through folded link: %v", err)
+	}
+}
+
+func TestExecuteUnfoldsDirectoryLink(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkgA := filepath.Join(stowDir, "pkg-a")
+	pkgB := filepath.Join(stowDir, "pkg-b")
+	mustWriteFile(t, filepath.Join(pkgA, "config", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(pkgB, "config", "bravo.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	config := filepath.Join(targetDir, "config")
+	if err := os.Symlink(filepath.Join(pkgA, "config"), config); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg-b"},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	if err := Execute(plan, ExecuteOptions{DryRun: false}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	info, err := os.Lstat(config)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("expected %s to be a real directory: %v", config, err)
+	}
+	for _, name := range []string{"alpha.txt", "bravo.txt"} {
+		linked := filepath.Join(config, name)
+		info, err := os.Lstat(linked)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("expected symlink at %s: %v", linked, err)
+		}
+	}
+}
+
+func TestExecuteAdoptsExistingFile(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	existing := filepath.Join(targetDir, "alpha.txt")
+	if err := os.WriteFile(existing, []byte("local"), 0o600); err != nil {
+		t.Fatalf("write %s: %v", existing, err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Adopt:    true,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	if err := Execute(plan, ExecuteOptions{DryRun: false}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	data, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatalf("read %s: %v", source, err)
+	}
+	if string(data) != "local" {
+		t.Fatalf("expected package copy to be replaced, got %q", data)
+	}
+	matches, err := symlinkMatches(OSFS{}, existing, source)
+	if err != nil {
+		t.Fatalf("symlinkMatches error: %v", err)
+	}
+	if !matches {
+		t.Fatalf("expected adopted target to link to source")
+	}
+}
+
+func TestExecuteRemovesSymlink(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	linked := filepath.Join(targetDir, "alpha.txt")
+	if err := os.Symlink(source, linked); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Action:   ActionDelete,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	if err := Execute(plan, ExecuteOptions{DryRun: false}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	if _, err := os.Lstat(linked); !os.IsNotExist(err) {
+		t.Fatalf("expected symlink to be removed, got %v", err)
+	}
+	if _, err := os.Stat(source); err != nil {
+		t.Fatalf("expected source to remain: %v", err)
+	}
+}
+
+func TestExecuteRollsBackOnFailure(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	alpha := filepath.Join(pkg, "alpha.txt")
+	bravo := filepath.Join(pkg, "bravo.txt")
+	charlie := filepath.Join(pkg, "charlie.txt")
+	mustWriteFile(t, alpha)
+	mustWriteFile(t, bravo)
+	mustWriteFile(t, charlie)
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	existing := filepath.Join(targetDir, "existing.txt")
+	if err := os.Symlink(charlie, existing); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+	adopted := filepath.Join(targetDir, "adopted.txt")
+	if err := os.WriteFile(adopted, []byte("local"), 0o644); err != nil {
+		t.Fatalf("write %s: %v", adopted, err)
+	}
+	blocked := filepath.Join(targetDir, "blocked.txt")
+	mustWriteFile(t, blocked)
+
+	nested := filepath.Join(targetDir, "new", "nested")
+	plan := PlanResult{Operations: []Operation{
+		{Kind: OpUnlink, Source: charlie, Target: existing},
+		{Kind: OpLink, Source: alpha, Target: filepath.Join(nested, "alpha.txt")},
+		{Kind: OpAdopt, Source: bravo, Target: adopted},
+		{Kind: OpLink, Source: charlie, Target: blocked},
+	}}
+
+	err := Execute(plan, ExecuteOptions{})
+	var oerr *OpError
+	if !errors.As(err, &oerr) {
+		t.Fatalf("expected OpError, got %v", err)
+	}
+	if oerr.Target != blocked {
+		t.Fatalf("unexpected failed target: %s", oerr.Target)
+	}
+
+	if matches, err := symlinkMatches(OSFS{}, existing, charlie); err != nil || !matches {
+		t.Fatalf("expected removed link to be restored: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "new")); !os.IsNotExist(err) {
+		t.Fatalf("expected created directories to be removed, got %v", err)
+	}
+	if data, err := os.ReadFile(adopted); err != nil || string(data) != "local" {
+		t.Fatalf("expected adopted file to be restored, got %q: %v", data, err)
+	}
+	if data, err := os.ReadFile(bravo); err != nil || string(data) != "data" {
+		t.Fatalf("expected package copy to be restored, got %q: %v", data, err)
+	}
+	entries, err := os.ReadDir(pkg)
+	if err != nil {
+		t.Fatalf("read %s: %v", pkg, err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected no leftover files in package, got %d entries", len(entries))
+	}
+}
+
+// cancelLogger cancels its context when it is told about the operation on
+// target, which Execute does just before applying it.
+type cancelLogger struct {
+	target string
+	cancel context.CancelFunc
+}
+
+func (l *cancelLogger) Logf(level int, format string, args ...any) {
+	for _, arg := range args {
+		if arg == l.target {
+			l.cancel()
+		}
+	}
+}
+
+func TestExecuteContextRollsBackOnCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		failUndo    bool
+		wantApplied int
+	}{
+		{name: "rolled back"},
+		{name: "undo fails", failUndo: true, wantApplied: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewMemFS()
+			stowDir, targetDir := memPath("stow"), memPath("home")
+			mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "alpha.txt"))
+			mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "bravo.txt"))
+			if err := m.MkdirAll(targetDir, 0o755); err != nil {
+				t.Fatalf("MkdirAll error: %v", err)
+			}
+			plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, FS: m})
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			alpha := filepath.Join(targetDir, "alpha.txt")
+			bravo := filepath.Join(targetDir, "bravo.txt")
+			if tc.failUndo {
+				m.Fail("remove", alpha, errors.New("busy"))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err = ExecuteContext(ctx, plan, ExecuteOptions{FS: m, Logger: &cancelLogger{target: alpha, cancel: cancel}})
+			var oerr *OpError
+			if !errors.As(err, &oerr) || !errors.Is(err, context.Canceled) {
+				t.Fatalf("expected an OpError wrapping context.Canceled, got %v", err)
+			}
+			if oerr.Target != bravo {
+				t.Fatalf("expected the unstarted operation %s, got %s", bravo, oerr.Target)
+			}
+			if len(oerr.Applied) != tc.wantApplied {
+				t.Fatalf("expected %d applied operations, got %+v", tc.wantApplied, oerr.Applied)
+			}
+			if tc.wantApplied > 0 && oerr.Applied[0].Target != alpha {
+				t.Fatalf("expected %s to be reported as applied, got %+v", alpha, oerr.Applied)
+			}
+			if _, err := m.Lstat(alpha); os.IsNotExist(err) == tc.failUndo {
+				t.Fatalf("unexpected state of %s after rollback: %v", alpha, err)
+			}
+			if _, err := m.Lstat(bravo); !os.IsNotExist(err) {
+				t.Fatalf("expected %s not to be linked, got %v", bravo, err)
+			}
+		})
+	}
+}
+
+func TestExecutionOrderRemovesBeforeCreating(t *testing.T) {
+	ops := []Operation{
+		{Kind: OpLink, Target: "link-a"},
+		{Kind: OpMkdir, Target: "mkdir"},
+		{Kind: OpUnlink, Target: "unlink"},
+		{Kind: OpRmdir, Target: "rmdir-child"},
+		{Kind: OpLink, Target: "link-b"},
+		{Kind: OpRmdir, Target: "rmdir-parent"},
+	}
+
+	got := executionOrder(ops)
+
+	want := []string{"unlink", "rmdir-child", "rmdir-parent", "mkdir", "link-a", "link-b"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d operations, got %d", len(want), len(got))
+	}
+	for i, op := range got {
+		if op.Target != want[i] {
+			t.Fatalf("operation %d mismatch: got %s, want %s", i, op.Target, want[i])
+		}
+	}
+}
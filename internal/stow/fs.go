@@ -0,0 +1,140 @@
+package stow
+
+import (
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// FS is the filesystem BuildPlan and Execute work on. Paths are absolute and
+// use the host separator. Errors follow the os package: a missing path
+// satisfies errors.Is(err, fs.ErrNotExist).
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of the directory, in any order.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Readlink(name string) (string, error)
+	ReadFile(name string) ([]byte, error)
+	// WriteFile creates or truncates the file; perm applies on creation.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Mkdir(name string, perm fs.FileMode) error
+	Symlink(oldname, newname string) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// OSFS is the FS of the operating system.
+type OSFS struct{}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (OSFS) Lstat(name string) (fs.FileInfo, error)     { return os.Lstat(name) }
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (OSFS) Readlink(name string) (string, error)       { return os.Readlink(name) }
+func (OSFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (OSFS) Mkdir(name string, perm fs.FileMode) error  { return os.Mkdir(name, perm) }
+func (OSFS) Symlink(oldname, newname string) error      { return os.Symlink(oldname, newname) }
+func (OSFS) Rename(oldpath, newpath string) error       { return os.Rename(oldpath, newpath) }
+func (OSFS) Remove(name string) error                   { return os.Remove(name) }
+func (OSFS) RemoveAll(name string) error                { return os.RemoveAll(name) }
+func (OSFS) Chmod(name string, mode fs.FileMode) error  { return os.Chmod(name, mode) }
+
+func (OSFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+// orOS returns fsys, or OSFS when it is nil.
+func orOS(fsys FS) FS {
+	if fsys == nil {
+		return OSFS{}
+	}
+	return fsys
+}
+
+// tempName returns a path in dir that does not exist yet, built from pattern
+// the way os.CreateTemp does: the last "*" is replaced by a random string.
+// The caller creates the file or directory.
+func tempName(fsys FS, dir, pattern string) (string, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(rand.Uint64(), 36)+suffix)
+		if _, err := fsys.Lstat(name); os.IsNotExist(err) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// evalSymlinks is filepath.EvalSymlinks on fsys: it returns the absolute path
+// with every symlink resolved. The path must exist.
+func evalSymlinks(fsys FS, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	sep := string(filepath.Separator)
+	vol := filepath.VolumeName(abs)
+	resolved := vol + sep
+	rest := strings.Split(abs[len(vol):], sep)
+	for links := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		info, err := fsys.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", &os.PathError{Op: "evalsymlinks", Path: path, Err: syscall.ELOOP}
+		}
+		dest, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			vol = filepath.VolumeName(dest)
+			resolved = vol + sep
+			dest = dest[len(vol):]
+		}
+		rest = append(strings.Split(dest, sep), rest...)
+	}
+	return resolved, nil
+}
+
+// evalParents resolves the symlinks in the existing directories above path
+// and keeps its last element, which may be a symlink, and any missing
+// directories as they are.
+func evalParents(fsys FS, path string) string {
+	dir, rest := filepath.Dir(path), filepath.Base(path)
+	for {
+		if resolved, err := evalSymlinks(fsys, dir); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path
+		}
+		dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+	}
+}
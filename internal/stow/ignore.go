@@ -0,0 +1,167 @@
+package stow
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// LocalIgnoreFile is the per-package ignore list, read from the package root.
+	LocalIgnoreFile = ".stow-local-ignore"
+	// GlobalIgnoreFile is the ignore list read from the home directory when a
+	// package has no local ignore list.
+	GlobalIgnoreFile = ".stow-global-ignore"
+)
+
+// defaultIgnorePatterns is used when neither ignore file exists. It follows
+// GNU Stow's built-in list, plus Vim swap files.
+var defaultIgnorePatterns = []string{
+	`RCS`,
+	`.+,v`,
+	`CVS`,
+	`\.\#.+`,
+	`\.cvsignore`,
+	`\.svn`,
+	`_darcs`,
+	`\.hg`,
+	`\.git`,
+	`\.gitignore`,
+	`\.gitmodules`,
+	`.+~`,
+	`\#.*\#`,
+	`\..+\.sw[a-p]`,
+	`^/README.*`,
+	`^/LICENSE.*`,
+	`^/COPYING`,
+}
+
+var trailingComment = regexp.MustCompile(`\s+#.*$`)
+
+// ignoreList decides which package entries are skipped. Patterns containing a
+// slash match against the package-relative path with a leading slash; other
+// patterns must match the whole basename. Suffix patterns come from the
+// command line and match the end of the package-relative path.
+type ignoreList struct {
+	path     *regexp.Regexp
+	basename *regexp.Regexp
+	suffix   *regexp.Regexp
+}
+
+// loadIgnoreList builds the ignore list for the package at pkgPath from its
+// local ignore file, the global ignore file, or the built-in defaults, in that
+// order of preference, combined with the suffix patterns.
+func loadIgnoreList(fsys FS, pkgPath string, suffixes []string) (*ignoreList, error) {
+	localPath := filepath.Join(pkgPath, LocalIgnoreFile)
+	patterns, err := readIgnoreFile(fsys, localPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, &PathError{Path: localPath, Err: err}
+	}
+	source := localPath
+	if os.IsNotExist(err) {
+		patterns, source, err = globalIgnorePatterns(fsys)
+		if err != nil {
+			return nil, &PathError{Path: source, Err: err}
+		}
+	}
+	list, err := compileIgnoreList(patterns, suffixes)
+	if err != nil {
+		return nil, &PathError{Path: source, Err: err}
+	}
+	return list, nil
+}
+
+func globalIgnorePatterns(fsys FS) ([]string, string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return defaultIgnorePatterns, "", nil
+	}
+	globalPath := filepath.Join(home, GlobalIgnoreFile)
+	patterns, err := readIgnoreFile(fsys, globalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultIgnorePatterns, "", nil
+		}
+		return nil, globalPath, err
+	}
+	return patterns, globalPath, nil
+}
+
+func readIgnoreFile(fsys FS, path string) ([]string, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseIgnorePatterns(bytes.NewReader(data))
+}
+
+// parseIgnorePatterns reads one pattern per line. Blank lines and lines
+// starting with # are skipped, trailing whitespace-separated comments are
+// removed, and \# stands for a literal #.
+func parseIgnorePatterns(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = trailingComment.ReplaceAllString(line, "")
+		patterns = append(patterns, strings.ReplaceAll(line, `\#`, "#"))
+	}
+	return patterns, scanner.Err()
+}
+
+func compileIgnoreList(patterns, suffixes []string) (*ignoreList, error) {
+	var pathPatterns, basenamePatterns []string
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "/") {
+			pathPatterns = append(pathPatterns, pattern)
+		} else {
+			basenamePatterns = append(basenamePatterns, pattern)
+		}
+	}
+
+	list := &ignoreList{}
+	var err error
+	if len(pathPatterns) > 0 {
+		expr := `(?:^|/)(?:` + strings.Join(pathPatterns, "|") + `)(?:/|$)`
+		if list.path, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern: %w", err)
+		}
+	}
+	if len(basenamePatterns) > 0 {
+		expr := `^(?:` + strings.Join(basenamePatterns, "|") + `)$`
+		if list.basename, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern: %w", err)
+		}
+	}
+	if len(suffixes) > 0 {
+		expr := `(?:` + strings.Join(suffixes, "|") + `)$`
+		if list.suffix, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern: %w", err)
+		}
+	}
+	return list, nil
+}
+
+// match reports whether the entry at the package-relative path rel is ignored.
+func (l *ignoreList) match(rel string) bool {
+	if l == nil {
+		return false
+	}
+	slashRel := filepath.ToSlash(rel)
+	if l.path != nil && l.path.MatchString("/"+slashRel) {
+		return true
+	}
+	if l.basename != nil && l.basename.MatchString(path.Base(slashRel)) {
+		return true
+	}
+	return l.suffix != nil && l.suffix.MatchString(slashRel)
+}
@@ -0,0 +1,112 @@
+package stow
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnorePatterns(t *testing.T) {
+	input := strings.Join([]string{
+		"# comment",
+		"",
+		"  \\.git  ",
+		"build    # trailing comment",
+		"\\#.*\\#",
+	}, "\n")
+
+	patterns, err := parseIgnorePatterns(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseIgnorePatterns error: %v", err)
+	}
+
+	expected := []string{`\.git`, `build`, `#.*#`}
+	if len(patterns) != len(expected) {
+		t.Fatalf("expected %d patterns, got %q", len(expected), patterns)
+	}
+	for i, pattern := range patterns {
+		if pattern != expected[i] {
+			t.Fatalf("pattern %d mismatch: got %q, want %q", i, pattern, expected[i])
+		}
+	}
+}
+
+func TestIgnoreListMatch(t *testing.T) {
+	list, err := compileIgnoreList(defaultIgnorePatterns, []string{`\.bak`})
+	if err != nil {
+		t.Fatalf("compileIgnoreList error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		rel     string
+		ignored bool
+	}{
+		{rel: ".git", ignored: true},
+		{rel: filepath.Join("sub", ".gitignore"), ignored: true},
+		{rel: "README.md", ignored: true},
+		{rel: filepath.Join("doc", "README.md"), ignored: false},
+		{rel: "notes.txt~", ignored: true},
+		{rel: ".vimrc.swp", ignored: true},
+		{rel: filepath.Join("dir", "file.bak"), ignored: true},
+		{rel: ".gitconfig", ignored: false},
+		{rel: ".bashrc", ignored: false},
+	} {
+		if got := list.match(tc.rel); got != tc.ignored {
+			t.Errorf("match(%q) = %v, want %v", tc.rel, got, tc.ignored)
+		}
+	}
+}
+
+func TestLoadIgnoreListPrecedence(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	stowDir := t.TempDir()
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+
+	list, err := loadIgnoreList(OSFS{}, pkg, nil)
+	if err != nil {
+		t.Fatalf("loadIgnoreList error: %v", err)
+	}
+	if !list.match(".git") {
+		t.Fatalf("expected default list to ignore .git")
+	}
+
+	if err := os.WriteFile(filepath.Join(home, GlobalIgnoreFile), []byte("global\n"), 0o644); err != nil {
+		t.Fatalf("write global ignore: %v", err)
+	}
+	list, err = loadIgnoreList(OSFS{}, pkg, nil)
+	if err != nil {
+		t.Fatalf("loadIgnoreList error: %v", err)
+	}
+	if !list.match("global") || list.match(".git") {
+		t.Fatalf("expected global list to replace defaults")
+	}
+
+	if err := os.WriteFile(filepath.Join(pkg, LocalIgnoreFile), []byte("local\n"), 0o644); err != nil {
+		t.Fatalf("write local ignore: %v", err)
+	}
+	list, err = loadIgnoreList(OSFS{}, pkg, nil)
+	if err != nil {
+		t.Fatalf("loadIgnoreList error: %v", err)
+	}
+	if !list.match("local") || list.match("global") {
+		t.Fatalf("expected local list to replace global list")
+	}
+}
+
+func TestLoadIgnoreListInvalidPattern(t *testing.T) {
+	stowDir := t.TempDir()
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	if err := os.WriteFile(filepath.Join(pkg, LocalIgnoreFile), []byte("(unclosed\n"), 0o644); err != nil {
+		t.Fatalf("write local ignore: %v", err)
+	}
+
+	if _, err := loadIgnoreList(OSFS{}, pkg, nil); err == nil {
+		t.Fatalf("expected error for invalid pattern")
+	}
+}
@@ -0,0 +1,67 @@
+package stow
+
+import (
+	"errors"
+	"slices"
+)
+
+// journal records the changes Execute makes so that a failed execution can
+// be undone. Undo steps run in reverse order; cleanup steps run only once
+// every operation has succeeded.
+type journal struct {
+	undo    []undoStep
+	cleanup []func() error
+	// op is the operation the next undo steps belong to.
+	op Operation
+}
+
+type undoStep struct {
+	op   Operation
+	undo func() error
+}
+
+// begin attributes the undo steps recorded from now on to op.
+func (j *journal) begin(op Operation) {
+	j.op = op
+}
+
+func (j *journal) record(undo func() error) {
+	j.undo = append(j.undo, undoStep{op: j.op, undo: undo})
+}
+
+func (j *journal) onCommit(cleanup func() error) {
+	j.cleanup = append(j.cleanup, cleanup)
+}
+
+// rollback undoes every recorded change, newest first. It keeps going after
+// a failed step and returns all failures joined, together with the
+// operations whose changes were not all undone, oldest first.
+func (j *journal) rollback() ([]Operation, error) {
+	var (
+		errs    []error
+		applied []Operation
+	)
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		step := j.undo[i]
+		if err := step.undo(); err != nil {
+			errs = append(errs, err)
+			if n := len(applied); n == 0 || applied[n-1] != step.op {
+				applied = append(applied, step.op)
+			}
+		}
+	}
+	j.undo = nil
+	j.cleanup = nil
+	slices.Reverse(applied)
+	return applied, errors.Join(errs...)
+}
+
+// commit discards the undo steps and runs the cleanup steps. Cleanup
+// failures leave only stray temporary files behind, so they are ignored.
+func (j *journal) commit() {
+	for _, cleanup := range j.cleanup {
+		_ = cleanup()
+	}
+	j.undo = nil
+	j.cleanup = nil
+}
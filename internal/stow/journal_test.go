@@ -0,0 +1,49 @@
+package stow
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJournalRollbackOrder(t *testing.T) {
+	var order []int
+	failure := errors.New("undo failed")
+
+	first := Operation{Kind: OpMkdir, Target: "first"}
+	second := Operation{Kind: OpLink, Target: "second"}
+
+	j := &journal{}
+	j.begin(first)
+	j.record(func() error { order = append(order, 1); return nil })
+	j.begin(second)
+	j.record(func() error { order = append(order, 2); return failure })
+	j.record(func() error { order = append(order, 3); return nil })
+	j.onCommit(func() error { t.Fatalf("cleanup must not run on rollback"); return nil })
+
+	applied, err := j.rollback()
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected rollback error to wrap undo failure, got %v", err)
+	}
+	if len(applied) != 1 || applied[0] != second {
+		t.Fatalf("expected only the second operation to remain applied, got %v", applied)
+	}
+	if len(order) != 3 || order[0] != 3 || order[1] != 2 || order[2] != 1 {
+		t.Fatalf("expected undo steps in reverse order, got %v", order)
+	}
+}
+
+func TestJournalCommitRunsCleanup(t *testing.T) {
+	cleaned := false
+
+	j := &journal{}
+	j.record(func() error { t.Fatalf("undo must not run on commit"); return nil })
+	j.onCommit(func() error { cleaned = true; return nil })
+	j.commit()
+
+	if !cleaned {
+		t.Fatalf("expected cleanup to run")
+	}
+	if _, err := j.rollback(); err != nil {
+		t.Fatalf("expected empty rollback after commit, got %v", err)
+	}
+}
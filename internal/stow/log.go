@@ -0,0 +1,59 @@
+package stow
+
+import (
+	"fmt"
+	"io"
+)
+
+// Verbosity levels, matching GNU Stow's -v levels.
+const (
+	// LevelOps reports each link, unlink and directory change.
+	LevelOps = 1
+	// LevelDecisions reports planning decisions: targets already linked,
+	// ignored entries, folding, unfolding, defer and override.
+	LevelDecisions = 2
+	// LevelTrace traces the directories walked while planning.
+	LevelTrace = 3
+)
+
+// Logger receives verbose messages from planning and execution. level is one
+// of the Level constants; implementations decide which levels to keep.
+type Logger interface {
+	Logf(level int, format string, args ...any)
+}
+
+// NewLogger returns a Logger that writes messages up to verbosity to w, one
+// per line.
+func NewLogger(w io.Writer, verbosity int) Logger {
+	return &writerLogger{w: w, verbosity: verbosity}
+}
+
+type writerLogger struct {
+	w         io.Writer
+	verbosity int
+}
+
+func (l *writerLogger) Logf(level int, format string, args ...any) {
+	if level > l.verbosity {
+		return
+	}
+	fmt.Fprintf(l.w, format+"\n", args...)
+}
+
+// logf sends a message to log, which may be nil.
+func logf(log Logger, level int, format string, args ...any) {
+	if log != nil {
+		log.Logf(level, format, args...)
+	}
+}
+
+// logOperation reports op at LevelOps in GNU Stow's "LINK: target => source"
+// form.
+func logOperation(log Logger, op Operation) {
+	switch op.Kind {
+	case OpLink, OpAdopt:
+		logf(log, LevelOps, "%s: %s => %s", op.Kind, op.Target, op.Source)
+	default:
+		logf(log, LevelOps, "%s: %s", op.Kind, op.Target)
+	}
+}
@@ -0,0 +1,81 @@
+package stow
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Logf(level int, format string, args ...any) {
+	l.messages = append(l.messages, fmt.Sprintf("%d %s", level, fmt.Sprintf(format, args...)))
+}
+
+func (l *recordingLogger) has(level int, prefix string) bool {
+	for _, message := range l.messages {
+		if strings.HasPrefix(message, fmt.Sprintf("%d %s", level, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewLoggerFiltersLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, LevelDecisions)
+	log.Logf(LevelOps, "ops %d", 1)
+	log.Logf(LevelDecisions, "decision")
+	log.Logf(LevelTrace, "trace")
+	if buf.String() != "ops 1\ndecision\n" {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+}
+
+func TestBuildPlanLogsDecisions(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "dir", "bravo.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "notes.orig"))
+
+	log := &recordingLogger{}
+	opts := Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, Ignore: []string{`\.orig`}, Logger: log}
+	plan, err := BuildPlan(opts)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if !log.has(LevelDecisions, "--- Ignoring "+filepath.Join(stowDir, "pkg", "notes.orig")) {
+		t.Fatalf("expected ignore decision, got %q", log.messages)
+	}
+	if !log.has(LevelDecisions, "--- Folding "+filepath.Join(targetDir, "dir")) {
+		t.Fatalf("expected folding decision, got %q", log.messages)
+	}
+	if !log.has(LevelTrace, "Walking "+filepath.Join(stowDir, "pkg")) {
+		t.Fatalf("expected traversal trace, got %q", log.messages)
+	}
+
+	if !symlinkSupported(t, targetDir) {
+		return
+	}
+	log.messages = nil
+	if err := Execute(plan, ExecuteOptions{Logger: log}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if !log.has(LevelOps, "LINK: "+filepath.Join(targetDir, "alpha.txt")+" => ") {
+		t.Fatalf("expected link message, got %q", log.messages)
+	}
+
+	log.messages = nil
+	if _, err := BuildPlan(opts); err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if !log.has(LevelDecisions, "--- Skipping "+filepath.Join(targetDir, "alpha.txt")+" as it already points to") {
+		t.Fatalf("expected already-linked decision, got %q", log.messages)
+	}
+}
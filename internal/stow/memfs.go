@@ -0,0 +1,442 @@
+package stow
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxSymlinks bounds the symlinks followed while resolving one path.
+const maxSymlinks = 40
+
+// MemFS is an in-memory FS. It supports symlinks, which are resolved in every
+// path component, enforces the owner read and write permission bits of files
+// and directories, and can be told to fail chosen calls with Fail. Volumes
+// and their root directories exist implicitly. It is safe for concurrent use.
+type MemFS struct {
+	mu     sync.Mutex
+	roots  map[string]*memNode
+	faults map[memFault]error
+}
+
+type memNode struct {
+	mode     fs.FileMode
+	data     []byte
+	link     string
+	children map[string]*memNode
+}
+
+type memFault struct {
+	op, name string
+}
+
+// NewMemFS returns an empty in-memory filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		roots:  make(map[string]*memNode),
+		faults: make(map[memFault]error),
+	}
+}
+
+// Fail makes every later call of the method op (such as "lstat", "symlink"
+// or "rename", the lowercase method name) on name return err, wrapped like
+// the os package would. For Symlink and Rename either path matches. A nil err
+// clears the fault.
+func (m *MemFS) Fail(op, name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memFault{op: op, name: filepath.Clean(name)}
+	if err == nil {
+		delete(m.faults, key)
+		return
+	}
+	m.faults[key] = err
+}
+
+// MkdirAll creates the directory name and any missing parents.
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	if info, err := m.Stat(name); err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := m.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := m.Mkdir(name, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(filepath.Base(name)), nil
+}
+
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(filepath.Base(name)), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	if n.mode&0o400 == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for childName, child := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info(childName)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return n.link, nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case n.mode.IsDir():
+		return nil, &fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	case n.mode&0o400 == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("writefile", name, true)
+	switch {
+	case err == nil:
+		if n.mode.IsDir() {
+			return &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if n.mode&0o200 == 0 {
+			return &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+		}
+		n.data = append([]byte(nil), data...)
+		return nil
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	dir, base, err := m.parent("open", name)
+	if err != nil {
+		return err
+	}
+	if _, exists := dir.children[base]; exists {
+		// A dangling symlink.
+		return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	dir.children[base] = &memNode{mode: perm & fs.ModePerm, data: append([]byte(nil), data...)}
+	return nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fault("mkdir", name); err != nil {
+		return err
+	}
+	dir, base, err := m.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, exists := dir.children[base]; exists {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	dir.children[base] = &memNode{mode: fs.ModeDir | perm&fs.ModePerm, children: make(map[string]*memNode)}
+	return nil
+}
+
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.linkFault("symlink", oldname, newname); err != nil {
+		return err
+	}
+	dir, base, err := m.parent("symlink", newname)
+	if err != nil {
+		return linkError("symlink", oldname, newname, err)
+	}
+	if _, exists := dir.children[base]; exists {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	dir.children[base] = &memNode{mode: fs.ModeSymlink | 0o777, link: oldname}
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.linkFault("rename", oldpath, newpath); err != nil {
+		return err
+	}
+	srcDir, srcBase, err := m.parent("rename", oldpath)
+	if err != nil {
+		return linkError("rename", oldpath, newpath, err)
+	}
+	src, ok := srcDir.children[srcBase]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	dstDir, dstBase, err := m.parent("rename", newpath)
+	if err != nil {
+		return linkError("rename", oldpath, newpath, err)
+	}
+	if src.mode.IsDir() && src.contains(dstDir) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EINVAL}
+	}
+	if dst, exists := dstDir.children[dstBase]; exists && dst != src {
+		var err error
+		switch {
+		case dst.mode.IsDir() && !src.mode.IsDir():
+			err = syscall.EISDIR
+		case !dst.mode.IsDir() && src.mode.IsDir():
+			err = syscall.ENOTDIR
+		case dst.mode.IsDir() && len(dst.children) > 0:
+			err = syscall.ENOTEMPTY
+		}
+		if err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+	}
+	delete(srcDir.children, srcBase)
+	dstDir.children[dstBase] = src
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fault("remove", name); err != nil {
+		return err
+	}
+	dir, base, err := m.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.children[base]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	case n.mode.IsDir() && len(n.children) > 0:
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fault("removeall", name); err != nil {
+		return err
+	}
+	dir, base, err := m.parent("unlinkat", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&^fs.ModePerm | mode&fs.ModePerm
+	return nil
+}
+
+// fault returns the error injected for op on name, if any.
+func (m *MemFS) fault(op, name string) error {
+	if err, ok := m.faults[memFault{op: op, name: filepath.Clean(name)}]; ok {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (m *MemFS) linkFault(op, oldname, newname string) error {
+	for _, name := range []string{oldname, newname} {
+		if err, ok := m.faults[memFault{op: op, name: filepath.Clean(name)}]; ok {
+			return &os.LinkError{Op: op, Old: oldname, New: newname, Err: err}
+		}
+	}
+	return nil
+}
+
+// lookup checks for an injected fault and resolves name, following a final
+// symlink when follow is set.
+func (m *MemFS) lookup(op, name string, follow bool) (*memNode, error) {
+	if err := m.fault(op, name); err != nil {
+		return nil, err
+	}
+	n, err := m.resolve(name, follow, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return n, nil
+}
+
+// parent returns the writable directory that holds name and the base name
+// within it.
+func (m *MemFS) parent(op, name string) (*memNode, string, error) {
+	clean := filepath.Clean(name)
+	dirPath := filepath.Dir(clean)
+	if dirPath == clean {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir, err := m.resolve(dirPath, true, 0)
+	switch {
+	case err != nil:
+	case !dir.mode.IsDir():
+		err = syscall.ENOTDIR
+	case dir.mode&0o200 == 0:
+		err = fs.ErrPermission
+	}
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return dir, filepath.Base(clean), nil
+}
+
+// resolve walks the absolute path name, following symlinks in every
+// component but the last, and the last too when follow is set.
+func (m *MemFS) resolve(name string, follow bool, depth int) (*memNode, error) {
+	if !filepath.IsAbs(name) {
+		return nil, fs.ErrInvalid
+	}
+	clean := filepath.Clean(name)
+	vol := filepath.VolumeName(clean)
+	parts := strings.FieldsFunc(clean[len(vol):], func(r rune) bool {
+		return r < 0x80 && os.IsPathSeparator(uint8(r))
+	})
+	cur := m.root(vol)
+	curPath := vol + string(filepath.Separator)
+	for i, part := range parts {
+		if !cur.mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		child, ok := cur.children[part]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		if child.mode&fs.ModeSymlink != 0 && (follow || i < len(parts)-1) {
+			if depth >= maxSymlinks {
+				return nil, syscall.ELOOP
+			}
+			dest := child.link
+			if !filepath.IsAbs(dest) {
+				dest = filepath.Join(curPath, dest)
+			}
+			var err error
+			if child, err = m.resolve(dest, true, depth+1); err != nil {
+				return nil, err
+			}
+			curPath = dest
+		} else {
+			curPath = filepath.Join(curPath, part)
+		}
+		cur = child
+	}
+	return cur, nil
+}
+
+func (m *MemFS) root(vol string) *memNode {
+	root, ok := m.roots[vol]
+	if !ok {
+		root = &memNode{mode: fs.ModeDir | 0o755, children: make(map[string]*memNode)}
+		m.roots[vol] = root
+	}
+	return root
+}
+
+// contains reports whether other is n or one of its descendants.
+func (n *memNode) contains(other *memNode) bool {
+	if n == other {
+		return true
+	}
+	for _, child := range n.children {
+		if child.contains(other) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return memInfo{name: name, mode: n.mode, size: int64(len(n.data))}
+}
+
+func linkError(op, oldname, newname string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &os.LinkError{Op: op, Old: oldname, New: newname, Err: err}
+}
+
+// memInfo is a snapshot of a MemFS node.
+type memInfo struct {
+	name string
+	mode fs.FileMode
+	size int64
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
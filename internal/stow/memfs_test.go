@@ -0,0 +1,215 @@
+package stow
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// memPath returns an absolute MemFS path made of the slash-separated rel.
+func memPath(rel string) string {
+	root := filepath.VolumeName(os.TempDir()) + string(filepath.Separator)
+	return filepath.Join(root, filepath.FromSlash(rel))
+}
+
+func mustMemWriteFile(t *testing.T, m *MemFS, path string) {
+	t.Helper()
+	if err := m.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir %s: %v", filepath.Dir(path), err)
+	}
+	if err := m.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestMemFSResolvesSymlinks(t *testing.T) {
+	m := NewMemFS()
+	mustMemWriteFile(t, m, memPath("pkg/dir/alpha.txt"))
+	if err := m.Symlink(filepath.Join("..", "pkg", "dir"), memPath("target/dir")); err == nil {
+		t.Fatalf("expected symlink into a missing directory to fail")
+	}
+	if err := m.MkdirAll(memPath("target"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	if err := m.Symlink(filepath.Join("..", "pkg", "dir"), memPath("target/dir")); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+
+	if info, err := m.Lstat(memPath("target/dir")); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Fatalf("expected Lstat to report a symlink, got %v, %v", info, err)
+	}
+	if info, err := m.Stat(memPath("target/dir")); err != nil || !info.IsDir() {
+		t.Fatalf("expected Stat to follow the symlink, got %v, %v", info, err)
+	}
+	if data, err := m.ReadFile(memPath("target/dir/alpha.txt")); err != nil || string(data) != "data" {
+		t.Fatalf("expected to read through the symlink, got %q, %v", data, err)
+	}
+	if dest, err := linkDestination(m, memPath("target/dir")); err != nil || dest != memPath("pkg/dir") {
+		t.Fatalf("unexpected link destination %q, %v", dest, err)
+	}
+
+	if err := m.Symlink("loop", memPath("target/loop")); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	if _, err := m.Stat(memPath("target/loop")); !errors.Is(err, syscall.ELOOP) {
+		t.Fatalf("expected ELOOP for a symlink loop, got %v", err)
+	}
+	if _, err := m.Stat(memPath("target/missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing path to not exist, got %v", err)
+	}
+}
+
+func TestMemFSPermissions(t *testing.T) {
+	m := NewMemFS()
+	dir := memPath("locked")
+	mustMemWriteFile(t, m, filepath.Join(dir, "alpha.txt"))
+
+	if err := m.Chmod(dir, 0o500); err != nil {
+		t.Fatalf("Chmod error: %v", err)
+	}
+	if err := m.Mkdir(filepath.Join(dir, "sub"), 0o755); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected Mkdir in a read-only directory to be denied, got %v", err)
+	}
+	if err := m.Remove(filepath.Join(dir, "alpha.txt")); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected Remove in a read-only directory to be denied, got %v", err)
+	}
+
+	if err := m.Chmod(dir, 0o300); err != nil {
+		t.Fatalf("Chmod error: %v", err)
+	}
+	if _, err := m.ReadDir(dir); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected ReadDir of an unreadable directory to be denied, got %v", err)
+	}
+}
+
+func TestMemFSRename(t *testing.T) {
+	m := NewMemFS()
+	mustMemWriteFile(t, m, memPath("a/dir/alpha.txt"))
+	mustMemWriteFile(t, m, memPath("b/full/bravo.txt"))
+
+	if err := m.Rename(memPath("a/dir"), memPath("b/full")); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected renaming over a non-empty directory to fail, got %v", err)
+	}
+	if err := m.Rename(memPath("a/dir"), memPath("a/dir/inner")); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected renaming a directory into itself to fail, got %v", err)
+	}
+	if err := m.Rename(memPath("a/dir"), memPath("b/moved")); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	if _, err := m.Lstat(memPath("a/dir")); !os.IsNotExist(err) {
+		t.Fatalf("expected the old path to be gone, got %v", err)
+	}
+	if _, err := m.Lstat(memPath("b/moved/alpha.txt")); err != nil {
+		t.Fatalf("expected the tree to move with its directory: %v", err)
+	}
+}
+
+func TestMemFSFail(t *testing.T) {
+	m := NewMemFS()
+	path := memPath("alpha.txt")
+	mustMemWriteFile(t, m, path)
+	injected := errors.New("injected")
+
+	m.Fail("lstat", path, injected)
+	if _, err := m.Lstat(path); !errors.Is(err, injected) {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+	if _, err := m.Stat(path); err != nil {
+		t.Fatalf("expected other methods to succeed, got %v", err)
+	}
+	m.Fail("lstat", path, nil)
+	if _, err := m.Lstat(path); err != nil {
+		t.Fatalf("expected the fault to be cleared, got %v", err)
+	}
+}
+
+func TestBuildPlanAndExecuteOnMemFS(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg-a", "config", "alpha.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg-b", "config", "bravo.txt"))
+	mustMemWriteFile(t, m, filepath.Join(targetDir, "charlie.txt"))
+	if err := m.Symlink(filepath.Join("..", "stow", "pkg-a", "config"), filepath.Join(targetDir, "config")); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg-b"},
+		FS:       m,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %+v", plan.Conflicts)
+	}
+	if err := Execute(plan, ExecuteOptions{FS: m}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	for _, name := range []string{"alpha.txt", "bravo.txt"} {
+		linked := filepath.Join(targetDir, "config", name)
+		info, err := m.Lstat(linked)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			t.Fatalf("expected %s to be a symlink after unfolding: %v", linked, err)
+		}
+	}
+	if info, err := m.Lstat(filepath.Join(targetDir, "config")); err != nil || !info.IsDir() {
+		t.Fatalf("expected config to be a real directory: %v", err)
+	}
+	if _, err := m.Stat(filepath.Join(targetDir, StateFile)); err != nil {
+		t.Fatalf("expected the state file to be written: %v", err)
+	}
+}
+
+func TestExecuteRollsBackInjectedFailure(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "sub", "bravo.txt"))
+	if err := m.MkdirAll(filepath.Join(targetDir, "sub"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	injected := errors.New("disk full")
+	failing := filepath.Join(targetDir, "sub", "bravo.txt")
+	m.Fail("symlink", failing, injected)
+
+	err = Execute(plan, ExecuteOptions{FS: m})
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Target != failing || !errors.Is(err, injected) {
+		t.Fatalf("expected OpError for %s wrapping the injected error, got %v", failing, err)
+	}
+	if _, err := m.Lstat(filepath.Join(targetDir, "alpha.txt")); !os.IsNotExist(err) {
+		t.Fatalf("expected the first link to be rolled back, got %v", err)
+	}
+	if _, err := m.Lstat(filepath.Join(targetDir, StateFile)); !os.IsNotExist(err) {
+		t.Fatalf("expected no state file after a rollback, got %v", err)
+	}
+}
+
+func TestBuildPlanReportsUnreadableTarget(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", "config", "alpha.txt"))
+	if err := m.MkdirAll(filepath.Join(targetDir, "config"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	if err := m.Chmod(filepath.Join(targetDir, "config"), 0o300); err != nil {
+		t.Fatalf("Chmod error: %v", err)
+	}
+
+	_, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, Action: ActionRestow, FS: m})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package stow
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// AllPackages, used as a package name, selects every package of the stow
+// directory that is not hidden, ignored or excluded.
+const AllPackages = "*"
+
+// isGlob reports whether the package name is a shell pattern.
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// expandActions replaces each action whose package name is a shell pattern
+// with one action per matching package of absDir, in name order. Patterns
+// only match packages ListPackages returns, and skip packages matched by the
+// ignore list (the global or built-in patterns plus suffixes), by an exclude
+// pattern, or named explicitly by another action. A pattern matching nothing
+// is an error. Repeated actions are dropped.
+func expandActions(fsys FS, absDir string, actions []PackageAction, suffixes, exclude []string) ([]PackageAction, error) {
+	if err := checkExclude(exclude); err != nil {
+		return nil, err
+	}
+	explicit := make(map[string]struct{}, len(actions))
+	for _, action := range actions {
+		if !isGlob(action.Package) {
+			explicit[action.Package] = struct{}{}
+		}
+	}
+
+	var (
+		available []string
+		filter    *packageFilter
+		out       []PackageAction
+	)
+	seen := make(map[PackageAction]struct{}, len(actions))
+	add := func(action PackageAction) {
+		if _, dup := seen[action]; !dup {
+			seen[action] = struct{}{}
+			out = append(out, action)
+		}
+	}
+	for _, action := range actions {
+		if !isGlob(action.Package) {
+			add(action)
+			continue
+		}
+		if _, err := filepath.Match(action.Package, ""); err != nil {
+			return nil, fmt.Errorf("invalid package pattern %q: %w", action.Package, err)
+		}
+		if available == nil {
+			var err error
+			if available, err = listPackages(fsys, absDir); err != nil {
+				return nil, err
+			}
+			if filter, err = newPackageFilter(fsys, suffixes, exclude); err != nil {
+				return nil, err
+			}
+		}
+		matched := false
+		for _, name := range available {
+			if ok, _ := filepath.Match(action.Package, name); !ok {
+				continue
+			}
+			if _, named := explicit[name]; named || filter.skips(name) {
+				continue
+			}
+			matched = true
+			add(PackageAction{Package: name, Action: action.Action})
+		}
+		if !matched {
+			return nil, &PathError{Path: filepath.Join(absDir, action.Package), Err: errors.New("no packages match")}
+		}
+	}
+	return out, nil
+}
+
+// allPackages returns the packages AllPackages stands for, possibly none, and
+// the filter that left out the others. Commands that default to every
+// package use it so that they skip the same packages as --all.
+func allPackages(fsys FS, absDir string, suffixes, exclude []string) ([]string, *packageFilter, error) {
+	if err := checkExclude(exclude); err != nil {
+		return nil, nil, err
+	}
+	available, err := listPackages(fsys, absDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter, err := newPackageFilter(fsys, suffixes, exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	packages := available[:0]
+	for _, name := range available {
+		if !filter.skips(name) {
+			packages = append(packages, name)
+		}
+	}
+	return packages, filter, nil
+}
+
+func checkExclude(exclude []string) error {
+	for _, pattern := range exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// expandPackages is expandActions for a list of package names.
+func expandPackages(fsys FS, absDir string, packages, suffixes, exclude []string) ([]string, error) {
+	actions := make([]PackageAction, 0, len(packages))
+	for _, pkg := range packages {
+		actions = append(actions, PackageAction{Package: pkg})
+	}
+	actions, err := expandActions(fsys, absDir, actions, suffixes, exclude)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(actions))
+	for _, action := range actions {
+		out = append(out, action.Package)
+	}
+	return out, nil
+}
+
+// packageFilter decides which packages package name patterns skip: those
+// matched by the ignore list applied to package names (the global ignore
+// file or the built-in defaults, plus suffixes) or by an exclude pattern.
+type packageFilter struct {
+	ignore  *ignoreList
+	exclude []string
+}
+
+func newPackageFilter(fsys FS, suffixes, exclude []string) (*packageFilter, error) {
+	patterns, source, err := globalIgnorePatterns(fsys)
+	if err != nil {
+		return nil, &PathError{Path: source, Err: err}
+	}
+	list, err := compileIgnoreList(patterns, suffixes)
+	if err != nil {
+		return nil, &PathError{Path: source, Err: err}
+	}
+	return &packageFilter{ignore: list, exclude: exclude}, nil
+}
+
+func (f *packageFilter) skips(name string) bool {
+	return f != nil && (f.ignore.match(name) || matchAny(f.exclude, name))
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
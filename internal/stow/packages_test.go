@@ -0,0 +1,135 @@
+package stow
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandActions(t *testing.T) {
+	m := NewMemFS()
+	stowDir := memPath("stow")
+	for _, name := range []string{"nvim", "nvim-lua", "zsh", "tmux", ".hidden", "CVS", "README.d", "work-mail"} {
+		if err := m.MkdirAll(filepath.Join(stowDir, name), 0o755); err != nil {
+			t.Fatalf("MkdirAll error: %v", err)
+		}
+	}
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "notes.txt"))
+
+	actions, err := expandActions(m, stowDir, []PackageAction{
+		{Package: AllPackages, Action: ActionRestow},
+		{Package: "zsh", Action: ActionDelete},
+		{Package: "nvim*", Action: ActionRestow},
+	}, nil, []string{"work-*"})
+	if err != nil {
+		t.Fatalf("expandActions error: %v", err)
+	}
+	expected := []PackageAction{
+		{Package: "nvim", Action: ActionRestow},
+		{Package: "nvim-lua", Action: ActionRestow},
+		{Package: "tmux", Action: ActionRestow},
+		{Package: "zsh", Action: ActionDelete},
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("unexpected actions:\n got: %+v\nwant: %+v", actions, expected)
+	}
+
+	packages, err := expandPackages(m, stowDir, []string{"*"}, []string{"^tmux$"}, nil)
+	if err != nil {
+		t.Fatalf("expandPackages error: %v", err)
+	}
+	if want := []string{"nvim", "nvim-lua", "work-mail", "zsh"}; !reflect.DeepEqual(packages, want) {
+		t.Fatalf("unexpected packages %q, want %q", packages, want)
+	}
+}
+
+func TestExpandActionsErrors(t *testing.T) {
+	m := NewMemFS()
+	stowDir := memPath("stow")
+	if err := m.MkdirAll(filepath.Join(stowDir, "zsh"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+
+	_, err := expandPackages(m, stowDir, []string{"nvim*"}, nil, nil)
+	var pathErr *PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != filepath.Join(stowDir, "nvim*") {
+		t.Fatalf("expected a PathError for the unmatched pattern, got %v", err)
+	}
+	if _, err := expandPackages(m, stowDir, []string{"*"}, nil, []string{"z*"}); err == nil {
+		t.Fatalf("expected an error when every match is excluded")
+	}
+	if _, err := expandPackages(m, stowDir, []string{"[z"}, nil, nil); err == nil || !strings.Contains(err.Error(), "invalid package pattern") {
+		t.Fatalf("expected an invalid package pattern error, got %v", err)
+	}
+	if _, err := expandPackages(m, stowDir, []string{"zsh"}, nil, []string{"[z"}); err == nil || !strings.Contains(err.Error(), "invalid exclude pattern") {
+		t.Fatalf("expected an invalid exclude pattern error, got %v", err)
+	}
+}
+
+func TestBuildPlanExpandsPackagePatterns(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "nvim", "alpha.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "nvim-lua", "bravo.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "zsh", "charlie.txt"))
+	if err := m.MkdirAll(targetDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"nvim*"}, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	var targets []string
+	for _, op := range plan.Operations {
+		targets = append(targets, filepath.Base(op.Target))
+	}
+	if want := []string{"alpha.txt", "bravo.txt"}; !reflect.DeepEqual(targets, want) {
+		t.Fatalf("unexpected targets %q, want %q", targets, want)
+	}
+}
+
+func TestStatusAndPruneSkipExcludedPackages(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "vim", "alpha.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "work", "bravo.txt"))
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "CVS", "charlie.txt"))
+	if err := m.MkdirAll(targetDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	// A dangling link into the excluded package.
+	stale := filepath.Join(targetDir, "gone.txt")
+	if err := m.Symlink(filepath.Join("..", "stow", "work", "gone.txt"), stale); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	opts := Options{Dir: stowDir, Target: targetDir, Exclude: []string{"work"}, FS: m}
+
+	statuses, err := Status(opts)
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Package != "vim" {
+		t.Fatalf("expected only vim to be reported, got %+v", statuses)
+	}
+
+	opts.Action = ActionPrune
+	plan, err := BuildPlan(opts)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Operations) != 0 {
+		t.Fatalf("expected links into excluded packages to be kept, got %+v", plan.Operations)
+	}
+
+	opts.Exclude = nil
+	plan, err = BuildPlan(opts)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0].Target != stale {
+		t.Fatalf("expected %s to be pruned without --exclude, got %+v", stale, plan.Operations)
+	}
+}
@@ -1,15 +1,63 @@
 package stow
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
 )
 
-// Operation describes a planned link from Source to Target.
+// OpKind identifies the filesystem change an Operation performs.
+type OpKind int
+
+const (
+	// OpLink creates a symlink at Target pointing to Source.
+	OpLink OpKind = iota
+	// OpUnlink removes the symlink at Target, which currently points to Source.
+	OpUnlink
+	// OpMkdir creates the directory Target for the package directory Source.
+	OpMkdir
+	// OpRmdir removes the empty directory Target for the package directory Source.
+	OpRmdir
+	// OpAdopt moves the file at Target into the package at Source, replacing
+	// the package copy, and then links Target to Source.
+	OpAdopt
+	// OpBackup moves the existing file, directory or symlink at Target to
+	// the backup path Source.
+	OpBackup
+	// OpRemove deletes the existing file, directory or symlink at Target so
+	// that the package entry Source can be linked there.
+	OpRemove
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpLink:
+		return "LINK"
+	case OpUnlink:
+		return "UNLINK"
+	case OpMkdir:
+		return "MKDIR"
+	case OpRmdir:
+		return "RMDIR"
+	case OpAdopt:
+		return "ADOPT"
+	case OpBackup:
+		return "BACKUP"
+	case OpRemove:
+		return "REMOVE"
+	default:
+		return fmt.Sprintf("OpKind(%d)", int(k))
+	}
+}
+
+// Operation describes a planned change to Target involving Source.
 type Operation struct {
+	Kind   OpKind
 	Source string
 	Target string
 }
@@ -17,27 +65,246 @@ type Operation struct {
 // Conflict describes a target path that cannot be linked.
 type Conflict struct {
 	Target string
+	// Reason is a human-readable description of Kind.
 	Reason string
+	Kind   ConflictKind
+	// Existing is the type of the file found at Target.
+	Existing FileType
+	// LinkDest is the clean absolute destination of Target when it is a
+	// symlink.
+	LinkDest string
+	// Package names the package of the stow directory that owns Target:
+	// the one LinkDest points into or, for a duplicate, the one already
+	// planned to link it.
+	Package string
 }
 
 // PlanResult contains the planned operations and any conflicts found.
 type PlanResult struct {
+	// Dir and Target are the absolute stow and target directories.
+	Dir        string
+	Target     string
 	Operations []Operation
 	Conflicts  []Conflict
 }
 
 type planState struct {
+	ctx      context.Context
+	fs       FS
+	action   Action
+	fold     bool
+	adopt    bool
+	ignore   []string
+	deferred *regexp.Regexp
+	override *regexp.Regexp
+	stowDir  string
+	// realDir is stowDir with its symlinks resolved; link destinations
+	// below it are mapped back below stowDir.
+	realDir     string
+	packages    map[string]struct{}
+	claims      map[string]int
+	pkgPath     string
 	result      PlanResult
 	seenTargets map[string]struct{}
+	// dirTargets holds the target directories packages descend into, which
+	// a package file cannot also be linked at.
+	dirTargets map[string]struct{}
+	linked     []Operation
+	linkIndex  map[string]int
+	removed    map[string]struct{}
+	unfolded   map[string]struct{}
+	log        Logger
+	scan       *scanner
+	onConflict ConflictPolicy
+	backupDir  string
+	backups    map[string]struct{}
+	// record is the state file of the target, naming the directories
+	// Execute created and unstowing may therefore remove.
+	record *State
+	// skipped, when set, names the packages whose links removeStaleLinks
+	// leaves alone.
+	skipped *packageFilter
+}
+
+func newPlanState(ctx context.Context, fsys FS, action Action, absDir, absTarget string) *planState {
+	realDir, err := evalSymlinks(fsys, absDir)
+	if err != nil {
+		realDir = absDir
+	}
+	return &planState{
+		ctx:         ctx,
+		fs:          fsys,
+		action:      action,
+		stowDir:     absDir,
+		realDir:     realDir,
+		packages:    make(map[string]struct{}),
+		claims:      make(map[string]int),
+		result:      PlanResult{Dir: absDir, Target: absTarget},
+		seenTargets: make(map[string]struct{}),
+		dirTargets:  make(map[string]struct{}),
+		linkIndex:   make(map[string]int),
+		removed:     make(map[string]struct{}),
+		unfolded:    make(map[string]struct{}),
+		backups:     make(map[string]struct{}),
+	}
+}
+
+func (s *planState) addOperation(op Operation) {
+	s.result.Operations = append(s.result.Operations, op)
+	switch op.Kind {
+	case OpLink:
+		s.linkIndex[op.Target] = len(s.result.Operations) - 1
+	case OpUnlink, OpRmdir, OpBackup, OpRemove:
+		s.removed[op.Target] = struct{}{}
+	}
+}
+
+// addLinked records a target that already links to its source.
+func (s *planState) addLinked(source, target string) {
+	logf(s.log, LevelDecisions, "--- Skipping %s as it already points to %s", target, source)
+	s.linked = append(s.linked, Operation{Kind: OpLink, Source: source, Target: target})
+}
+
+func (s *planState) addConflict(target string, kind ConflictKind) {
+	s.result.Conflicts = append(s.result.Conflicts, s.describeConflict(target, kind))
+}
+
+// lstatTarget is Lstat for target paths that accounts for planned
+// changes: paths planned for removal, and entries below an unfolded or
+// removed directory, do not exist.
+func (s *planState) lstatTarget(path string) (os.FileInfo, error) {
+	if s.plannedMissing(path) {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return s.fs.Lstat(path)
+}
+
+func (s *planState) plannedMissing(path string) bool {
+	if _, ok := s.removed[path]; ok {
+		return true
+	}
+	if len(s.unfolded) == 0 && len(s.removed) == 0 {
+		return false
+	}
+	for dir := filepath.Dir(path); dir != path; path, dir = dir, filepath.Dir(dir) {
+		if _, ok := s.unfolded[dir]; ok {
+			return true
+		}
+		if _, ok := s.removed[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// linkDestination is linkDestination for target paths: a destination inside
+// the stow directory is returned below stowDir even when the stow directory
+// is reached through a symlink, so it compares equal to package paths.
+func (s *planState) linkDestination(linkPath string) (string, error) {
+	dest, err := linkDestination(s.fs, linkPath)
+	if err != nil || s.realDir == s.stowDir || !isWithin(s.realDir, dest) {
+		return dest, err
+	}
+	rel, err := filepath.Rel(s.realDir, dest)
+	if err != nil {
+		return dest, nil
+	}
+	return filepath.Join(s.stowDir, rel), nil
+}
+
+// owns reports whether path lies inside a package of the stow directory.
+func (s *planState) owns(path string) bool {
+	return path != s.stowDir && isWithin(s.stowDir, path)
+}
+
+// packageRoot returns the package directory containing the owned path.
+func (s *planState) packageRoot(path string) string {
+	rel, err := filepath.Rel(s.stowDir, path)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(s.stowDir, strings.Split(rel, string(filepath.Separator))[0])
+}
+
+// Action selects what BuildPlan does with the packages.
+type Action int
+
+const (
+	// ActionStow links package contents into the target.
+	ActionStow Action = iota
+	// ActionDelete removes links that point into the packages.
+	ActionDelete
+	// ActionRestow links package contents like ActionStow and also removes
+	// links that point to package entries which no longer exist.
+	ActionRestow
+	// ActionPrune removes dangling links into the stow directory and the
+	// directories Execute created that are left empty.
+	ActionPrune
+)
+
+// PackageAction pairs a package with the action to apply to it.
+type PackageAction struct {
+	Package string
+	Action  Action
 }
 
 // Options describes inputs for planning.
 type Options struct {
-	Dir      string
-	Target   string
+	Dir    string
+	Target string
+	// Packages names the packages of Dir. A name holding shell pattern
+	// characters (*, ? or [) stands for the matching packages; see
+	// AllPackages and Exclude.
 	Packages []string
+	Action   Action
+	// Actions, when set, gives each package its own action and replaces
+	// Packages and Action. Deletions are planned first, so targets freed by
+	// a package being removed are available to packages stowed in the same
+	// run. ActionPrune cannot be used here.
+	Actions []PackageAction
+	// NoFolding disables tree folding, so directories are always created in
+	// the target and only leaf entries are linked.
+	NoFolding bool
+	// Adopt moves existing regular files found at target paths into the
+	// package, replacing the package copy, instead of reporting conflicts.
+	Adopt bool
+	// Ignore holds extra regular expressions; package entries whose
+	// package-relative path ends with a match are skipped.
+	Ignore []string
+	// Defer holds regular expressions matched against the start of
+	// target-relative paths; matching targets already stowed by another
+	// package are left to that package.
+	Defer []string
+	// Override holds regular expressions matched against the start of
+	// target-relative paths; matching targets already stowed by another
+	// package are relinked to this one.
+	Override []string
+	// Dotfiles maps package entries named "dot-x" to targets named ".x",
+	// at any depth.
+	Dotfiles bool
+	// Logger, when set, receives planning decisions (LevelDecisions) and
+	// directory traversal (LevelTrace).
+	Logger Logger
+	// OnConflict selects how existing targets that block a link are handled
+	// when stowing. Unstowing never removes anything but links.
+	OnConflict ConflictPolicy
+	// BackupDir, when set, receives ConflictBackup backups at their
+	// target-relative paths instead of next to the targets.
+	BackupDir string
+	// Exclude holds shell patterns of package names that package name
+	// patterns, such as AllPackages, do not match.
+	Exclude []string
+	// Concurrency bounds how many package directories are read at once.
+	// Zero means DefaultConcurrency and 1 reads them one at a time. It does
+	// not affect the plan.
+	Concurrency int
+	// FS is the filesystem planned against. Nil means OSFS.
+	FS FS
 }
 
+// ErrNoPackages is returned when there are no packages to plan.
+var ErrNoPackages = errors.New("at least one package is required")
+
 // PathError carries a path context for errors.
 type PathError struct {
 	Path string
@@ -64,151 +331,623 @@ func DefaultTarget(dir string) (string, error) {
 	return filepath.Dir(absDir), nil
 }
 
-// BuildPlan validates inputs and returns the planned operations.
+// BuildPlan validates inputs and returns the planned operations. Under
+// ConflictFail a plan with conflicts is returned together with a
+// *ConflictError.
 func BuildPlan(opts Options) (PlanResult, error) {
-	if len(opts.Packages) == 0 {
-		return PlanResult{}, errors.New("at least one package is required")
+	return BuildPlanContext(context.Background(), opts)
+}
+
+// BuildPlanContext is BuildPlan with cancellation, checked before each
+// package entry is scanned or planned. A cancelled plan returns ctx.Err().
+func BuildPlanContext(ctx context.Context, opts Options) (PlanResult, error) {
+	state, err := buildPlan(ctx, opts)
+	if err != nil {
+		return PlanResult{}, err
 	}
+	if opts.OnConflict == ConflictFail && len(state.result.Conflicts) > 0 {
+		return state.result, &ConflictError{Conflicts: state.result.Conflicts}
+	}
+	return state.result, nil
+}
 
+func buildPlan(ctx context.Context, opts Options) (*planState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	actions := opts.Actions
+	if len(actions) == 0 && opts.Action != ActionPrune {
+		for _, pkg := range opts.Packages {
+			actions = append(actions, PackageAction{Package: pkg, Action: opts.Action})
+		}
+	}
+	if len(actions) == 0 && opts.Action != ActionPrune {
+		return nil, ErrNoPackages
+	}
+	for _, action := range opts.Actions {
+		if action.Action == ActionPrune {
+			return nil, fmt.Errorf("package %s: prune cannot be combined with other actions", action.Package)
+		}
+	}
+
+	fsys := orOS(opts.FS)
 	absDir, err := filepath.Abs(opts.Dir)
 	if err != nil {
-		return PlanResult{}, &PathError{Path: opts.Dir, Err: err}
+		return nil, &PathError{Path: opts.Dir, Err: err}
 	}
-	info, err := os.Stat(absDir)
+	info, err := fsys.Stat(absDir)
 	if err != nil {
-		return PlanResult{}, &PathError{Path: absDir, Err: err}
+		return nil, &PathError{Path: absDir, Err: err}
 	}
 	if !info.IsDir() {
-		return PlanResult{}, &PathError{Path: absDir, Err: errors.New("dir is not a directory")}
+		return nil, &PathError{Path: absDir, Err: errors.New("dir is not a directory")}
 	}
 
 	absTarget, err := filepath.Abs(opts.Target)
 	if err != nil {
-		return PlanResult{}, &PathError{Path: opts.Target, Err: err}
+		return nil, &PathError{Path: opts.Target, Err: err}
+	}
+	if opts.Action == ActionPrune && len(opts.Actions) == 0 {
+		return buildPrunePlan(ctx, opts, absDir, absTarget)
+	}
+	if actions, err = expandActions(fsys, absDir, actions, opts.Ignore, opts.Exclude); err != nil {
+		return nil, err
 	}
 
-	packages := append([]string(nil), opts.Packages...)
-	sort.Strings(packages)
+	deferred, err := compilePrefixPatterns(opts.Defer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid defer pattern: %w", err)
+	}
+	override, err := compilePrefixPatterns(opts.Override)
+	if err != nil {
+		return nil, fmt.Errorf("invalid override pattern: %w", err)
+	}
 
-	state := planState{
-		result:      PlanResult{},
-		seenTargets: make(map[string]struct{}),
+	// Deletions first, then stows and restows, each in package order.
+	actions = append([]PackageAction(nil), actions...)
+	sort.SliceStable(actions, func(i, j int) bool {
+		di, dj := actions[i].Action == ActionDelete, actions[j].Action == ActionDelete
+		if di != dj {
+			return di
+		}
+		return actions[i].Package < actions[j].Package
+	})
+
+	scan := newScanner(ctx, fsys, opts.Dotfiles, opts.Logger, opts.Concurrency)
+	var pkgPaths []string
+	seen := make(map[string]struct{}, len(actions))
+	for _, action := range actions {
+		if _, dup := seen[action.Package]; dup {
+			continue
+		}
+		seen[action.Package] = struct{}{}
+		pkgPaths = append(pkgPaths, filepath.Join(absDir, action.Package))
 	}
-	for _, pkg := range packages {
-		pkgPath := filepath.Join(absDir, pkg)
-		pkgInfo, err := os.Stat(pkgPath)
-		if err != nil {
-			return PlanResult{}, &PathError{Path: pkgPath, Err: err}
+	scanned, err := scan.scanPackages(pkgPaths, opts.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	trees := make(map[string]*node, len(scanned))
+	for _, tree := range scanned {
+		trees[tree.name] = tree
+	}
+
+	record, err := loadState(fsys, absTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	state := newPlanState(ctx, fsys, opts.Action, absDir, absTarget)
+	state.record = record
+	state.scan = scan
+	state.fold = !opts.NoFolding
+	state.adopt = opts.Adopt
+	state.ignore = opts.Ignore
+	state.deferred = deferred
+	state.override = override
+	state.log = opts.Logger
+	state.onConflict = opts.OnConflict
+	if opts.BackupDir != "" {
+		if state.backupDir, err = filepath.Abs(opts.BackupDir); err != nil {
+			return nil, &PathError{Path: opts.BackupDir, Err: err}
 		}
-		if !pkgInfo.IsDir() {
-			return PlanResult{}, &PathError{Path: pkgPath, Err: errors.New("package is not a directory")}
+	}
+	for _, action := range actions {
+		if action.Action == ActionDelete {
+			continue
 		}
-		if err := walkPackage(pkgPath, absTarget, &state); err != nil {
-			return PlanResult{}, err
+		tree := trees[action.Package]
+		state.packages[tree.path] = struct{}{}
+		countClaims("", tree, state.claims)
+	}
+	for _, action := range actions {
+		state.action = action.Action
+		if err := walkPackage(trees[action.Package], absTarget, state); err != nil {
+			return nil, err
 		}
 	}
 
-	return state.result, nil
+	return state, nil
 }
 
-func walkPackage(pkgPath, targetRoot string, state *planState) error {
-	return walkDir(pkgPath, "", targetRoot, state)
+func walkPackage(tree *node, targetRoot string, state *planState) error {
+	state.pkgPath = tree.path
+	return walkDir(tree, "", targetRoot, state)
+}
+
+func walkDir(dir *node, rel, targetRoot string, state *planState) error {
+	logf(state.log, LevelTrace, "Walking %s => %s", dir.path, filepath.Join(targetRoot, rel))
+	if rel != "" && state.action != ActionDelete {
+		state.dirTargets[filepath.Join(targetRoot, rel)] = struct{}{}
+	}
+	for _, child := range dir.children {
+		if err := state.ctx.Err(); err != nil {
+			return err
+		}
+		relPath := filepath.Join(rel, child.target)
+		if child.isDir {
+			if err := handleDir(child, relPath, targetRoot, state); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := handleLeaf(child.path, relPath, targetRoot, state); err != nil {
+			return err
+		}
+	}
+	if state.action != ActionStow {
+		return removeStaleLinks(filepath.Join(targetRoot, rel), state.pkgPath, state)
+	}
+	return nil
 }
 
-func walkDir(root, rel, targetRoot string, state *planState) error {
-	entries, err := os.ReadDir(root)
+func handleDir(dir *node, relPath, targetRoot string, state *planState) error {
+	if state.action != ActionDelete {
+		return handleStowDir(dir, relPath, targetRoot, state)
+	}
+	targetPath := filepath.Join(targetRoot, relPath)
+	info, err := state.fs.Lstat(targetPath)
 	if err != nil {
-		return &PathError{Path: root, Err: err}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &PathError{Path: targetPath, Err: err}
+	}
+	if !info.IsDir() {
+		return handleUnlink(dir.path, targetPath, state)
+	}
+	if err := walkDir(dir, relPath, targetRoot, state); err != nil {
+		return err
+	}
+	return removeEmptyDir(dir.path, targetPath, state)
+}
+
+// handleStowDir folds the package directory into a single link when nothing
+// exists at the target and no other package in the run shares it. A folded
+// link owned by a package is unfolded when another package needs to share the
+// directory; otherwise the planner descends into the directory. A symlink
+// that does not point into the stow directory is a ConflictLinkElsewhere.
+func handleStowDir(dir *node, relPath, targetRoot string, state *planState) error {
+	targetPath := filepath.Join(targetRoot, relPath)
+	if _, exists := state.seenTargets[targetPath]; exists {
+		state.addConflict(targetPath, ConflictDuplicateTarget)
+		return nil
+	}
+	if _, unfolded := state.unfolded[targetPath]; unfolded {
+		return walkDir(dir, relPath, targetRoot, state)
+	}
+	info, err := state.lstatTarget(targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return &PathError{Path: targetPath, Err: err}
+		}
+		return foldOrDescend(dir, relPath, targetRoot, state)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		if info.IsDir() {
+			return walkDir(dir, relPath, targetRoot, state)
+		}
+		return resolveDirConflict(dir, relPath, targetRoot, ConflictTargetExists, state)
+	}
+
+	dest, err := state.linkDestination(targetPath)
+	if err != nil {
+		return &PathError{Path: targetPath, Err: err}
+	}
+	if !state.owns(dest) {
+		return resolveDirConflict(dir, relPath, targetRoot, ConflictLinkElsewhere, state)
+	}
+	if dest == dir.path && state.claims[relPath] == 1 && !renamesEntries(dir) {
+		state.seenTargets[targetPath] = struct{}{}
+		state.addLinked(dir.path, targetPath)
+		return nil
+	}
+	destInfo, err := state.fs.Stat(dest)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return &PathError{Path: dest, Err: err}
+		}
+		// The owned link is dangling, so it can simply be replaced.
+		state.addOperation(Operation{
+			Kind:   OpUnlink,
+			Source: dest,
+			Target: targetPath,
+		})
+		return foldOrDescend(dir, relPath, targetRoot, state)
+	}
+	if !destInfo.IsDir() {
+		return resolveDirConflict(dir, relPath, targetRoot, ConflictLinkElsewhere, state)
+	}
+	if err := unfold(dest, relPath, targetRoot, state); err != nil {
+		return err
+	}
+	return walkDir(dir, relPath, targetRoot, state)
+}
+
+// resolveDirConflict applies the conflict policy to the non-directory at the
+// target of a package directory and stows the directory if it was moved out
+// of the way.
+func resolveDirConflict(dir *node, relPath, targetRoot string, kind ConflictKind, state *planState) error {
+	resolved, err := resolveConflict(dir.path, filepath.Join(targetRoot, relPath), kind, state)
+	if err != nil || !resolved {
+		return err
+	}
+	return foldOrDescend(dir, relPath, targetRoot, state)
+}
+
+// foldOrDescend links the package directory whole when folding is on, no
+// other package claims it and no entry below it is renamed, as --dotfiles
+// renames dot- entries; otherwise it descends into it.
+func foldOrDescend(dir *node, relPath, targetRoot string, state *planState) error {
+	if state.fold && state.claims[relPath] == 1 && !renamesEntries(dir) {
+		logf(state.log, LevelDecisions, "--- Folding %s => %s", filepath.Join(targetRoot, relPath), dir.path)
+		return handleLeaf(dir.path, relPath, targetRoot, state)
+	}
+	return walkDir(dir, relPath, targetRoot, state)
+}
+
+// renamesEntries reports whether an entry below dir has a target name that
+// differs from its name, which a folded link would not translate.
+func renamesEntries(dir *node) bool {
+	for _, child := range dir.children {
+		if child.target != child.name || child.isDir && renamesEntries(child) {
+			return true
+		}
 	}
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
+	return false
+}
+
+// unfold plans replacing the folded link at relPath, which points to the
+// package directory existing, with a real directory. The entries of existing
+// are relinked individually unless its package takes part in the run, in
+// which case that package's own walk links them.
+func unfold(existing, relPath, targetRoot string, state *planState) error {
+	targetPath := filepath.Join(targetRoot, relPath)
+	logf(state.log, LevelDecisions, "--- Unfolding %s which pointed to %s", targetPath, existing)
+	state.addOperation(Operation{
+		Kind:   OpUnlink,
+		Source: existing,
+		Target: targetPath,
 	})
+	state.addOperation(Operation{
+		Kind:   OpMkdir,
+		Source: existing,
+		Target: targetPath,
+	})
+	state.unfolded[targetPath] = struct{}{}
+
+	owner := state.packageRoot(existing)
+	if _, planned := state.packages[owner]; planned {
+		return nil
+	}
+	ignore, err := loadIgnoreList(state.fs, owner, state.ignore)
+	if err != nil {
+		return err
+	}
+	ownerRel, err := filepath.Rel(owner, existing)
+	if err != nil {
+		return &PathError{Path: existing, Err: err}
+	}
+	tree, err := state.scan.withIgnore(ignore).scanTree(existing, ownerRel)
+	if err != nil {
+		return err
+	}
+	countClaims(relPath, tree, state.claims)
 
+	pkgPath := state.pkgPath
+	state.pkgPath = owner
+	err = walkDir(tree, relPath, targetRoot, state)
+	state.pkgPath = pkgPath
+	return err
+}
+
+// removeEmptyDir plans removal of a target directory whose entries are all
+// planned for removal. Only directories the state file records as created by
+// Execute are removed; directories that existed before stowing are kept.
+func removeEmptyDir(sourcePath, targetPath string, state *planState) error {
+	rel, ok := relSlash(state.result.Target, targetPath)
+	if !ok || state.record == nil {
+		return nil
+	}
+	if _, created := state.record.Owner(rel); !created {
+		return nil
+	}
+	entries, err := state.fs.ReadDir(targetPath)
+	if err != nil {
+		return &PathError{Path: targetPath, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
 	for _, entry := range entries {
-		name := entry.Name()
-		fullPath := filepath.Join(root, name)
-		relPath := filepath.Join(rel, name)
+		if _, removed := state.removed[filepath.Join(targetPath, entry.Name())]; !removed {
+			return nil
+		}
+	}
+	state.addOperation(Operation{
+		Kind:   OpRmdir,
+		Source: sourcePath,
+		Target: targetPath,
+	})
+	return nil
+}
 
-		if isSymlink(entry) {
-			if err := handleLeaf(fullPath, relPath, targetRoot, state); err != nil {
-				return err
-			}
+// removeStaleLinks plans removal of symlinks in targetDir that point beneath
+// root at entries which no longer exist.
+func removeStaleLinks(targetDir, root string, state *planState) error {
+	if _, unfolded := state.unfolded[targetDir]; unfolded {
+		return nil
+	}
+	stat := state.lstatTarget
+	if targetDir == state.result.Target {
+		// The target directory itself may be reached through a symlink.
+		stat = state.fs.Stat
+	}
+	info, err := stat(targetDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &PathError{Path: targetDir, Err: err}
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	entries, err := state.fs.ReadDir(targetDir)
+	if err != nil {
+		return &PathError{Path: targetDir, Err: err}
+	}
+	for _, entry := range entries {
+		if !isSymlink(entry) {
 			continue
 		}
-		if entry.IsDir() {
-			if err := walkDir(fullPath, relPath, targetRoot, state); err != nil {
-				return err
-			}
+		linkPath := filepath.Join(targetDir, entry.Name())
+		if _, removed := state.removed[linkPath]; removed {
 			continue
 		}
-		if err := handleLeaf(fullPath, relPath, targetRoot, state); err != nil {
-			return err
+		dest, err := state.linkDestination(linkPath)
+		if err != nil {
+			return &PathError{Path: linkPath, Err: err}
 		}
+		if !isWithin(root, dest) || state.owns(dest) && state.skipped.skips(state.packageName(dest)) {
+			continue
+		}
+		if _, err := state.fs.Lstat(dest); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return &PathError{Path: dest, Err: err}
+		}
+		state.addOperation(Operation{
+			Kind:   OpUnlink,
+			Source: dest,
+			Target: linkPath,
+		})
 	}
 	return nil
 }
 
 func handleLeaf(sourcePath, relPath, targetRoot string, state *planState) error {
 	targetPath := filepath.Join(targetRoot, relPath)
+	if state.action == ActionDelete {
+		return handleUnlink(sourcePath, targetPath, state)
+	}
 	if _, exists := state.seenTargets[targetPath]; exists {
-		state.result.Conflicts = append(state.result.Conflicts, Conflict{
-			Target: targetPath,
-			Reason: "duplicate target planned",
-		})
+		return handleDuplicate(sourcePath, relPath, targetPath, state)
+	}
+	if _, isDir := state.dirTargets[targetPath]; isDir {
+		state.addConflict(targetPath, ConflictDuplicateTarget)
 		return nil
 	}
 	state.seenTargets[targetPath] = struct{}{}
-	conflict, conflictReason, isNoOp, err := detectConflict(targetPath, sourcePath)
+	conflict, conflictKind, isNoOp, err := detectConflict(state, targetPath, sourcePath)
 	if err != nil {
 		return err
 	}
 	if isNoOp {
+		state.addLinked(sourcePath, targetPath)
 		return nil
 	}
 	if conflict {
-		state.result.Conflicts = append(state.result.Conflicts, Conflict{
-			Target: targetPath,
-			Reason: conflictReason,
-		})
+		if state.adopt {
+			adopt, err := adoptable(state.fs, targetPath, sourcePath)
+			if err != nil {
+				return err
+			}
+			if adopt {
+				state.addOperation(Operation{
+					Kind:   OpAdopt,
+					Source: sourcePath,
+					Target: targetPath,
+				})
+				return nil
+			}
+		}
+		handled, err := deferOrOverride(sourcePath, relPath, targetPath, state)
+		if err != nil || handled {
+			return err
+		}
+		resolved, err := resolveConflict(sourcePath, targetPath, conflictKind, state)
+		if err != nil || !resolved {
+			return err
+		}
+	}
+	state.addOperation(Operation{
+		Kind:   OpLink,
+		Source: sourcePath,
+		Target: targetPath,
+	})
+	return nil
+}
+
+func handleUnlink(sourcePath, targetPath string, state *planState) error {
+	info, err := state.fs.Lstat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &PathError{Path: targetPath, Err: err}
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		state.addConflict(targetPath, ConflictNotSymlink)
 		return nil
 	}
-	state.result.Operations = append(state.result.Operations, Operation{
+	matches, err := symlinkMatches(state.fs, targetPath, sourcePath)
+	if err != nil {
+		return &PathError{Path: targetPath, Err: err}
+	}
+	if !matches {
+		state.addConflict(targetPath, ConflictLinkElsewhere)
+		return nil
+	}
+	state.addOperation(Operation{
+		Kind:   OpUnlink,
 		Source: sourcePath,
 		Target: targetPath,
 	})
 	return nil
 }
 
-func detectConflict(targetPath, sourcePath string) (conflict bool, reason string, noOp bool, err error) {
-	info, err := os.Lstat(targetPath)
+func detectConflict(state *planState, targetPath, sourcePath string) (conflict bool, kind ConflictKind, noOp bool, err error) {
+	info, err := state.lstatTarget(targetPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false, "", false, nil
+			return false, 0, false, nil
 		}
-		return false, "", false, &PathError{Path: targetPath, Err: err}
+		return false, 0, false, &PathError{Path: targetPath, Err: err}
 	}
 	if info.Mode()&os.ModeSymlink != 0 {
-		matches, err := symlinkMatches(targetPath, sourcePath)
+		matches, err := symlinkMatches(state.fs, targetPath, sourcePath)
 		if err != nil {
-			return false, "", false, &PathError{Path: targetPath, Err: err}
+			return false, 0, false, &PathError{Path: targetPath, Err: err}
 		}
 		if matches {
-			return false, "", true, nil
+			return false, 0, true, nil
+		}
+		return true, ConflictLinkElsewhere, false, nil
+	}
+	return true, ConflictTargetExists, false, nil
+}
+
+// handleDuplicate resolves a target already claimed by an earlier package in
+// the run: deferred targets stay with the earlier package, overridden targets
+// move to this one, and anything else is a conflict.
+func handleDuplicate(sourcePath, relPath, targetPath string, state *planState) error {
+	rel := filepath.ToSlash(relPath)
+	if matchPrefix(state.deferred, rel) {
+		logf(state.log, LevelDecisions, "--- Deferring %s to the package already linking it", targetPath)
+		return nil
+	}
+	if matchPrefix(state.override, rel) {
+		if i, planned := state.linkIndex[targetPath]; planned {
+			logf(state.log, LevelDecisions, "--- Overriding %s with %s", targetPath, sourcePath)
+			state.result.Operations[i].Source = sourcePath
+			return nil
+		}
+		handled, err := deferOrOverride(sourcePath, relPath, targetPath, state)
+		if err != nil || handled {
+			return err
 		}
-		return true, "symlink points elsewhere", false, nil
 	}
-	return true, "target already exists", false, nil
+	state.addConflict(targetPath, ConflictDuplicateTarget)
+	return nil
 }
 
-func symlinkMatches(targetPath, sourcePath string) (bool, error) {
-	linkTarget, err := os.Readlink(targetPath)
+// deferOrOverride applies the defer and override patterns to a target that
+// is a symlink owned by another package. It reports whether the target was
+// handled.
+func deferOrOverride(sourcePath, relPath, targetPath string, state *planState) (bool, error) {
+	rel := filepath.ToSlash(relPath)
+	deferred := matchPrefix(state.deferred, rel)
+	if !deferred && !matchPrefix(state.override, rel) {
+		return false, nil
+	}
+	info, err := state.lstatTarget(targetPath)
 	if err != nil {
-		return false, err
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, &PathError{Path: targetPath, Err: err}
 	}
-	if !filepath.IsAbs(linkTarget) {
-		linkTarget = filepath.Join(filepath.Dir(targetPath), linkTarget)
+	if info.Mode()&os.ModeSymlink == 0 {
+		return false, nil
 	}
-	absLinkTarget, err := filepath.Abs(linkTarget)
+	dest, err := state.linkDestination(targetPath)
+	if err != nil {
+		return false, &PathError{Path: targetPath, Err: err}
+	}
+	if !state.owns(dest) {
+		return false, nil
+	}
+	if deferred {
+		logf(state.log, LevelDecisions, "--- Deferring %s to %s", targetPath, dest)
+		return true, nil
+	}
+	logf(state.log, LevelDecisions, "--- Overriding %s => %s with %s", targetPath, dest, sourcePath)
+	state.addOperation(Operation{
+		Kind:   OpUnlink,
+		Source: dest,
+		Target: targetPath,
+	})
+	state.addOperation(Operation{
+		Kind:   OpLink,
+		Source: sourcePath,
+		Target: targetPath,
+	})
+	return true, nil
+}
+
+// compilePrefixPatterns joins patterns into one expression anchored at the
+// start of the input. It returns nil when there are no patterns.
+func compilePrefixPatterns(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(`^(?:` + strings.Join(patterns, "|") + `)`)
+}
+
+func matchPrefix(re *regexp.Regexp, rel string) bool {
+	return re != nil && re.MatchString(rel)
+}
+
+// adoptable reports whether the existing target can be moved into the
+// package: both the target and the package entry must be regular files.
+func adoptable(fsys FS, targetPath, sourcePath string) (bool, error) {
+	targetInfo, err := fsys.Lstat(targetPath)
+	if err != nil {
+		return false, &PathError{Path: targetPath, Err: err}
+	}
+	sourceInfo, err := fsys.Lstat(sourcePath)
+	if err != nil {
+		return false, &PathError{Path: sourcePath, Err: err}
+	}
+	return targetInfo.Mode().IsRegular() && sourceInfo.Mode().IsRegular(), nil
+}
+
+// symlinkMatches reports whether the symlink at targetPath leads to
+// sourcePath. Symlinks in the directories of both paths are resolved, so a
+// relative link that only matches lexically but dangles does not match.
+func symlinkMatches(fsys FS, targetPath, sourcePath string) (bool, error) {
+	dest, err := linkDestination(fsys, targetPath)
 	if err != nil {
 		return false, err
 	}
@@ -216,7 +955,39 @@ func symlinkMatches(targetPath, sourcePath string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return filepath.Clean(absLinkTarget) == filepath.Clean(absSource), nil
+	return dest == evalParents(fsys, filepath.Clean(absSource)), nil
+}
+
+// linkDestination returns the absolute path the symlink at linkPath points
+// to, with the symlinks in its existing directories resolved. A relative link
+// is resolved from the symlink-resolved directory of linkPath, the way the
+// operating system follows it.
+func linkDestination(fsys FS, linkPath string) (string, error) {
+	linkTarget, err := fsys.Readlink(linkPath)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(linkTarget) {
+		dir, err := evalSymlinks(fsys, filepath.Dir(linkPath))
+		if err != nil {
+			dir = filepath.Dir(linkPath)
+		}
+		linkTarget = filepath.Join(dir, linkTarget)
+	}
+	absLinkTarget, err := filepath.Abs(linkTarget)
+	if err != nil {
+		return "", err
+	}
+	return evalParents(fsys, filepath.Clean(absLinkTarget)), nil
+}
+
+// isWithin reports whether path is root or lies beneath it.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 func isSymlink(entry os.DirEntry) bool {
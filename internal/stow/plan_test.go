@@ -1,8 +1,11 @@
 package stow
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 )
@@ -23,9 +26,10 @@ func TestBuildPlanMappingAndOrder(t *testing.T) {
 	mustWriteFile(t, filepath.Join(pkgB, "echo.txt"))
 
 	plan, err := BuildPlan(Options{
-		Dir:      stowDir,
-		Target:   targetDir,
-		Packages: []string{"pkg-b", "pkg-a"},
+		Dir:       stowDir,
+		Target:    targetDir,
+		Packages:  []string{"pkg-b", "pkg-a"},
+		NoFolding: true,
 	})
 	if err != nil {
 		t.Fatalf("BuildPlan error: %v", err)
@@ -51,6 +55,325 @@ func TestBuildPlanMappingAndOrder(t *testing.T) {
 	}
 }
 
+func TestBuildPlanFoldsUnclaimedDirectories(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkgA := filepath.Join(stowDir, "pkg-a")
+	pkgB := filepath.Join(stowDir, "pkg-b")
+	mustWriteFile(t, filepath.Join(pkgA, "config", "nvim", "init.vim"))
+	mustWriteFile(t, filepath.Join(pkgB, "config", "zsh", "zshrc"))
+	mustWriteFile(t, filepath.Join(pkgB, "local", "bin", "tool"))
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg-a", "pkg-b"},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := []Operation{
+		{Source: filepath.Join(stowDirAbs, "pkg-a", "config", "nvim"), Target: filepath.Join(targetAbs, "config", "nvim")},
+		{Source: filepath.Join(stowDirAbs, "pkg-b", "config", "zsh"), Target: filepath.Join(targetAbs, "config", "zsh")},
+		{Source: filepath.Join(stowDirAbs, "pkg-b", "local"), Target: filepath.Join(targetAbs, "local")},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+	}
+	for i, op := range plan.Operations {
+		if op != expected[i] {
+			t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+}
+
+func TestBuildPlanDoesNotFoldExistingDirectories(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "config", "alpha.txt"))
+	mustMkdir(t, filepath.Join(targetDir, "config"))
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := Operation{
+		Source: filepath.Join(stowDirAbs, "pkg", "config", "alpha.txt"),
+		Target: filepath.Join(targetAbs, "config", "alpha.txt"),
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0] != expected {
+		t.Fatalf("operations mismatch: got %+v, want [%+v]", plan.Operations, expected)
+	}
+}
+
+func TestBuildPlanNoOpForFoldedDirectory(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "config", "alpha.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	if err := os.Symlink(filepath.Join(pkg, "config"), filepath.Join(targetDir, "config")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Operations) != 0 || len(plan.Conflicts) != 0 {
+		t.Fatalf("expected empty plan, got %+v", plan)
+	}
+}
+
+func TestBuildPlanUnfoldsSharedDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		packages []string
+	}{
+		{name: "owner not in run", packages: []string{"pkg-b"}},
+		{name: "owner in run", packages: []string{"pkg-a", "pkg-b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stowDir := t.TempDir()
+			targetDir := t.TempDir()
+
+			pkgA := filepath.Join(stowDir, "pkg-a")
+			pkgB := filepath.Join(stowDir, "pkg-b")
+			mustWriteFile(t, filepath.Join(pkgA, "config", "alpha.txt"))
+			mustWriteFile(t, filepath.Join(pkgA, "config", "nvim", "init.vim"))
+			mustWriteFile(t, filepath.Join(pkgB, "config", "zsh", "zshrc"))
+
+			if !symlinkSupported(t, stowDir) {
+				return
+			}
+
+			if err := os.Symlink(filepath.Join(pkgA, "config"), filepath.Join(targetDir, "config")); err != nil {
+				t.Skipf("symlink creation failed: %v", err)
+			}
+
+			plan, err := BuildPlan(Options{
+				Dir:      stowDir,
+				Target:   targetDir,
+				Packages: tc.packages,
+			})
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			stowDirAbs, _ := filepath.Abs(stowDir)
+			targetAbs, _ := filepath.Abs(targetDir)
+			expected := []Operation{
+				{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "pkg-a", "config"), Target: filepath.Join(targetAbs, "config")},
+				{Kind: OpMkdir, Source: filepath.Join(stowDirAbs, "pkg-a", "config"), Target: filepath.Join(targetAbs, "config")},
+				{Kind: OpLink, Source: filepath.Join(stowDirAbs, "pkg-a", "config", "alpha.txt"), Target: filepath.Join(targetAbs, "config", "alpha.txt")},
+				{Kind: OpLink, Source: filepath.Join(stowDirAbs, "pkg-a", "config", "nvim"), Target: filepath.Join(targetAbs, "config", "nvim")},
+				{Kind: OpLink, Source: filepath.Join(stowDirAbs, "pkg-b", "config", "zsh"), Target: filepath.Join(targetAbs, "config", "zsh")},
+			}
+			if len(plan.Operations) != len(expected) {
+				t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+			}
+			for i, op := range plan.Operations {
+				if op != expected[i] {
+					t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+				}
+			}
+			if len(plan.Conflicts) != 0 {
+				t.Fatalf("expected no conflicts, got %+v", plan.Conflicts)
+			}
+		})
+	}
+}
+
+func TestBuildPlanSkipsIgnoredEntries(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, ".git", "HEAD"))
+	mustWriteFile(t, filepath.Join(pkg, "README.md"))
+	mustWriteFile(t, filepath.Join(pkg, ".vimrc"))
+	mustWriteFile(t, filepath.Join(pkg, ".vimrc.orig"))
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Ignore:   []string{`\.orig`},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := Operation{
+		Source: filepath.Join(stowDirAbs, "pkg", ".vimrc"),
+		Target: filepath.Join(targetAbs, ".vimrc"),
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0] != expected {
+		t.Fatalf("operations mismatch: got %+v, want [%+v]", plan.Operations, expected)
+	}
+}
+
+func TestBuildPlanDotfiles(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	bashrc := filepath.Join(pkg, "dot-bashrc")
+	initVim := filepath.Join(pkg, "dot-config", "nvim", "dot-init.vim")
+	mustWriteFile(t, bashrc)
+	mustWriteFile(t, initVim)
+
+	plan, err := BuildPlan(Options{
+		Dir:       stowDir,
+		Target:    targetDir,
+		Packages:  []string{"pkg"},
+		NoFolding: true,
+		Dotfiles:  true,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := []Operation{
+		{Source: filepath.Join(stowDirAbs, "pkg", "dot-bashrc"), Target: filepath.Join(targetAbs, ".bashrc")},
+		{Source: filepath.Join(stowDirAbs, "pkg", "dot-config", "nvim", "dot-init.vim"), Target: filepath.Join(targetAbs, ".config", "nvim", ".init.vim")},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+	}
+	for i, op := range plan.Operations {
+		if op != expected[i] {
+			t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+	if err := Execute(plan, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	unstow, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Action:   ActionDelete,
+		Dotfiles: true,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	expected = []Operation{
+		{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "pkg", "dot-bashrc"), Target: filepath.Join(targetAbs, ".bashrc")},
+		{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "pkg", "dot-config", "nvim", "dot-init.vim"), Target: filepath.Join(targetAbs, ".config", "nvim", ".init.vim")},
+		{Kind: OpRmdir, Source: filepath.Join(stowDirAbs, "pkg", "dot-config", "nvim"), Target: filepath.Join(targetAbs, ".config", "nvim")},
+		{Kind: OpRmdir, Source: filepath.Join(stowDirAbs, "pkg", "dot-config"), Target: filepath.Join(targetAbs, ".config")},
+	}
+	if len(unstow.Operations) != len(expected) {
+		t.Fatalf("expected %d unstow operations, got %+v", len(expected), unstow.Operations)
+	}
+	for i, op := range unstow.Operations {
+		if op != expected[i] {
+			t.Fatalf("unstow operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+}
+
+func TestBuildPlanDotfilesDoesNotFoldRenamedEntries(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	source := filepath.Join(stowDir, "pkg", "dot-config", "dot-nested", "dot-rc")
+	mustMemWriteFile(t, m, source)
+	if err := m.MkdirAll(targetDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, Dotfiles: true, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	expected := Operation{Kind: OpLink, Source: source, Target: filepath.Join(targetDir, ".config", ".nested", ".rc")}
+	if len(plan.Operations) != 1 || plan.Operations[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, plan.Operations)
+	}
+
+	// A folded link left by an earlier stow is unfolded on restow.
+	config := filepath.Join(targetDir, ".config")
+	if err := m.Symlink(filepath.Join("..", "stow", "pkg", "dot-config"), config); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+	restow, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, Action: ActionRestow, Dotfiles: true, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(restow, ExecuteOptions{FS: m}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if _, err := m.Lstat(expected.Target); err != nil {
+		t.Fatalf("expected %s after restowing: %v", expected.Target, err)
+	}
+}
+
+func TestBuildPlanAdoptDotfiles(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "dot-bashrc"))
+	mustWriteFile(t, filepath.Join(targetDir, ".bashrc"))
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Adopt:    true,
+		Dotfiles: true,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := Operation{
+		Kind:   OpAdopt,
+		Source: filepath.Join(stowDirAbs, "pkg", "dot-bashrc"),
+		Target: filepath.Join(targetAbs, ".bashrc"),
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0] != expected {
+		t.Fatalf("operations mismatch: got %+v, want [%+v]", plan.Operations, expected)
+	}
+}
+
 func TestBuildPlanConflictDetection(t *testing.T) {
 	stowDir := t.TempDir()
 	targetDir := t.TempDir()
@@ -81,6 +404,68 @@ func TestBuildPlanConflictDetection(t *testing.T) {
 	}
 }
 
+func TestBuildPlanForeignSymlinkedDirectoryConflicts(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg", ".config", "nvim", "init.vim"))
+	if err := m.MkdirAll(memPath("other/shared"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	if err := m.MkdirAll(targetDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	config := filepath.Join(targetDir, ".config")
+	if err := m.Symlink(filepath.Join("..", "other", "shared"), config); err != nil {
+		t.Fatalf("Symlink error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, FS: m})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Operations) != 0 {
+		t.Fatalf("expected nothing to be linked through the foreign symlink, got %+v", plan.Operations)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Target != config || plan.Conflicts[0].Kind != ConflictLinkElsewhere {
+		t.Fatalf("expected a link-elsewhere conflict for %s, got %+v", config, plan.Conflicts)
+	}
+}
+
+func TestBuildPlanAdoptExistingFiles(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "alpha.txt"))
+	mustWriteFile(t, filepath.Join(pkg, "bravo"))
+	mustWriteFile(t, filepath.Join(targetDir, "alpha.txt"))
+	mustMkdir(t, filepath.Join(targetDir, "bravo"))
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Adopt:    true,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expectedOp := Operation{
+		Kind:   OpAdopt,
+		Source: filepath.Join(stowDirAbs, "pkg", "alpha.txt"),
+		Target: filepath.Join(targetAbs, "alpha.txt"),
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0] != expectedOp {
+		t.Fatalf("operations mismatch: got %+v, want [%+v]", plan.Operations, expectedOp)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Target != filepath.Join(targetAbs, "bravo") {
+		t.Fatalf("expected directory to remain a conflict, got %+v", plan.Conflicts)
+	}
+}
+
 func TestBuildPlanDuplicateTargets(t *testing.T) {
 	stowDir := t.TempDir()
 	targetDir := t.TempDir()
@@ -126,6 +511,144 @@ func TestBuildPlanDuplicateTargets(t *testing.T) {
 	}
 }
 
+func TestBuildPlanDuplicateFileAndDirectory(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dirPkg  string
+		filePkg string
+	}{
+		{name: "directory first", dirPkg: "pkg-a", filePkg: "pkg-b"},
+		{name: "file first", dirPkg: "pkg-b", filePkg: "pkg-a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewMemFS()
+			stowDir, targetDir := memPath("stow"), memPath("home")
+			mustMemWriteFile(t, m, filepath.Join(stowDir, tc.dirPkg, ".foo", "x"))
+			mustMemWriteFile(t, m, filepath.Join(stowDir, tc.filePkg, ".foo"))
+			if err := m.MkdirAll(targetDir, 0o755); err != nil {
+				t.Fatalf("MkdirAll error: %v", err)
+			}
+
+			plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg-a", "pkg-b"}, FS: m})
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			foo := filepath.Join(targetDir, ".foo")
+			if len(plan.Conflicts) != 1 || plan.Conflicts[0].Target != foo || plan.Conflicts[0].Kind != ConflictDuplicateTarget {
+				t.Fatalf("expected a duplicate target conflict for %s, got %+v", foo, plan.Conflicts)
+			}
+			var file, below bool
+			for _, op := range plan.Operations {
+				file = file || op.Target == foo
+				below = below || isWithin(foo, op.Target) && op.Target != foo
+			}
+			if file && below {
+				t.Fatalf("expected %s to be linked as a file or a directory, not both: %+v", foo, plan.Operations)
+			}
+		})
+	}
+}
+
+func TestBuildPlanDeferAndOverrideDuplicates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     Options
+		expected string
+	}{
+		{name: "defer", opts: Options{Defer: []string{`\.gitconfig`}}, expected: "base"},
+		{name: "override", opts: Options{Override: []string{`\.git`}}, expected: "work"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stowDir := t.TempDir()
+			targetDir := t.TempDir()
+
+			mustWriteFile(t, filepath.Join(stowDir, "base", ".gitconfig"))
+			mustWriteFile(t, filepath.Join(stowDir, "work", ".gitconfig"))
+
+			opts := tc.opts
+			opts.Dir = stowDir
+			opts.Target = targetDir
+			opts.Packages = []string{"work", "base"}
+			plan, err := BuildPlan(opts)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			stowDirAbs, _ := filepath.Abs(stowDir)
+			targetAbs, _ := filepath.Abs(targetDir)
+			expected := Operation{
+				Source: filepath.Join(stowDirAbs, tc.expected, ".gitconfig"),
+				Target: filepath.Join(targetAbs, ".gitconfig"),
+			}
+			if len(plan.Operations) != 1 || plan.Operations[0] != expected {
+				t.Fatalf("operations mismatch: got %+v, want [%+v]", plan.Operations, expected)
+			}
+			if len(plan.Conflicts) != 0 {
+				t.Fatalf("expected no conflicts, got %+v", plan.Conflicts)
+			}
+		})
+	}
+}
+
+func TestBuildPlanDeferAndOverrideExistingLinks(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     Options
+		relink   bool
+		conflict bool
+	}{
+		{name: "default", opts: Options{}, conflict: true},
+		{name: "defer", opts: Options{Defer: []string{`\.git`}}},
+		{name: "override", opts: Options{Override: []string{`\.gitconfig`}}, relink: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stowDir := t.TempDir()
+			targetDir := t.TempDir()
+
+			base := filepath.Join(stowDir, "base", ".gitconfig")
+			mustWriteFile(t, base)
+			mustWriteFile(t, filepath.Join(stowDir, "work", ".gitconfig"))
+
+			if !symlinkSupported(t, stowDir) {
+				return
+			}
+			if err := os.Symlink(base, filepath.Join(targetDir, ".gitconfig")); err != nil {
+				t.Skipf("symlink creation failed: %v", err)
+			}
+
+			opts := tc.opts
+			opts.Dir = stowDir
+			opts.Target = targetDir
+			opts.Packages = []string{"work"}
+			plan, err := BuildPlan(opts)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			stowDirAbs, _ := filepath.Abs(stowDir)
+			targetAbs, _ := filepath.Abs(targetDir)
+			var expected []Operation
+			if tc.relink {
+				expected = []Operation{
+					{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "base", ".gitconfig"), Target: filepath.Join(targetAbs, ".gitconfig")},
+					{Kind: OpLink, Source: filepath.Join(stowDirAbs, "work", ".gitconfig"), Target: filepath.Join(targetAbs, ".gitconfig")},
+				}
+			}
+			if len(plan.Operations) != len(expected) {
+				t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+			}
+			for i, op := range plan.Operations {
+				if op != expected[i] {
+					t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+				}
+			}
+			if got := len(plan.Conflicts) != 0; got != tc.conflict {
+				t.Fatalf("unexpected conflicts: %+v", plan.Conflicts)
+			}
+		})
+	}
+}
+
 func TestBuildPlanNoOpForExistingSymlink(t *testing.T) {
 	stowDir := t.TempDir()
 	targetDir := t.TempDir()
@@ -160,6 +683,464 @@ func TestBuildPlanNoOpForExistingSymlink(t *testing.T) {
 	}
 }
 
+func TestBuildPlanDeleteUnlinksMatchingSymlinks(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustMkdir(t, pkg)
+	alpha := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, alpha)
+	mustWriteFile(t, filepath.Join(pkg, "bravo.txt"))
+	mustWriteFile(t, filepath.Join(pkg, "charlie.txt"))
+	mustWriteFile(t, filepath.Join(pkg, "delta.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	if err := os.Symlink(alpha, filepath.Join(targetDir, "alpha.txt")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+	foreign := filepath.Join(targetDir, "bravo.txt")
+	mustWriteFile(t, foreign)
+	elsewhere := filepath.Join(targetDir, "charlie.txt")
+	if err := os.Symlink(filepath.Join(stowDir, "symlink-target"), elsewhere); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Action:   ActionDelete,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expectedOp := Operation{
+		Kind:   OpUnlink,
+		Source: filepath.Join(stowDirAbs, "pkg", "alpha.txt"),
+		Target: filepath.Join(targetAbs, "alpha.txt"),
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0] != expectedOp {
+		t.Fatalf("operations mismatch: got %+v, want [%+v]", plan.Operations, expectedOp)
+	}
+
+	expectedConflicts := []Conflict{
+		{Target: foreign, Reason: "target is not a symlink", Kind: ConflictNotSymlink, Existing: FileRegular},
+		{
+			Target:   elsewhere,
+			Reason:   "symlink points elsewhere",
+			Kind:     ConflictLinkElsewhere,
+			Existing: FileSymlink,
+			LinkDest: filepath.Join(stowDirAbs, "symlink-target"),
+			Package:  "symlink-target",
+		},
+	}
+	if len(plan.Conflicts) != len(expectedConflicts) {
+		t.Fatalf("expected %d conflicts, got %+v", len(expectedConflicts), plan.Conflicts)
+	}
+	for i, conflict := range plan.Conflicts {
+		if conflict != expectedConflicts[i] {
+			t.Fatalf("conflict %d mismatch: got %+v, want %+v", i, conflict, expectedConflicts[i])
+		}
+	}
+}
+
+func TestBuildPlanDeleteRemovesEmptiedDirectories(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	source := filepath.Join(pkg, "nested", "alpha.txt")
+	mustWriteFile(t, source)
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	stow, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, NoFolding: true})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(stow, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Action:   ActionDelete,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := []Operation{
+		{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "pkg", "nested", "alpha.txt"), Target: filepath.Join(targetAbs, "nested", "alpha.txt")},
+		{Kind: OpRmdir, Source: filepath.Join(stowDirAbs, "pkg", "nested"), Target: filepath.Join(targetAbs, "nested")},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+	}
+	for i, op := range plan.Operations {
+		if op != expected[i] {
+			t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+}
+
+func TestBuildPlanDeleteKeepsPreexistingDirectories(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	source := filepath.Join(stowDir, "pkg", "nested", "alpha.txt")
+	mustWriteFile(t, source)
+	nested := filepath.Join(targetDir, "nested")
+	mustMkdir(t, nested)
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	stow, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(stow, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	unstow, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, Action: ActionDelete})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(unstow.Operations) != 1 || unstow.Operations[0].Kind != OpUnlink {
+		t.Fatalf("expected only the link to be removed, got %+v", unstow.Operations)
+	}
+	if err := Execute(unstow, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if info, err := os.Lstat(nested); err != nil || !info.IsDir() {
+		t.Fatalf("expected the pre-existing directory to be kept: %v", err)
+	}
+}
+
+func TestBuildPlanRestowKeepsValidLinks(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	alpha := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, alpha)
+	mustWriteFile(t, filepath.Join(pkg, "bravo.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	if err := os.Symlink(alpha, filepath.Join(targetDir, "alpha.txt")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(pkg, "gone.txt"), filepath.Join(targetDir, "gone.txt")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Action:   ActionRestow,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := []Operation{
+		{Kind: OpLink, Source: filepath.Join(stowDirAbs, "pkg", "bravo.txt"), Target: filepath.Join(targetAbs, "bravo.txt")},
+		{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "pkg", "gone.txt"), Target: filepath.Join(targetAbs, "gone.txt")},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+	}
+	for i, op := range plan.Operations {
+		if op != expected[i] {
+			t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+	if len(plan.Conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %+v", plan.Conflicts)
+	}
+}
+
+func TestBuildPlanMixedActionsFreeTargets(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	oldFile := filepath.Join(stowDir, "old", "alpha.txt")
+	oldDir := filepath.Join(stowDir, "old", "dir")
+	mustWriteFile(t, oldFile)
+	mustWriteFile(t, filepath.Join(oldDir, "bravo.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "new", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "new", "dir", "charlie.txt"))
+
+	if !symlinkSupported(t, targetDir) {
+		return
+	}
+	if err := os.Symlink(oldFile, filepath.Join(targetDir, "alpha.txt")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+	if err := os.Symlink(oldDir, filepath.Join(targetDir, "dir")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	// Stowing new alone conflicts with the links old owns.
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"new"}})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Conflicts) == 0 {
+		t.Fatalf("expected conflicts without unstowing old, got %+v", plan.Operations)
+	}
+
+	plan, err = BuildPlan(Options{
+		Dir:    stowDir,
+		Target: targetDir,
+		Actions: []PackageAction{
+			{Package: "new", Action: ActionStow},
+			{Package: "old", Action: ActionDelete},
+		},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %+v", plan.Conflicts)
+	}
+
+	stowDirAbs, _ := filepath.Abs(stowDir)
+	targetAbs, _ := filepath.Abs(targetDir)
+	expected := []Operation{
+		{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "old", "alpha.txt"), Target: filepath.Join(targetAbs, "alpha.txt")},
+		{Kind: OpUnlink, Source: filepath.Join(stowDirAbs, "old", "dir"), Target: filepath.Join(targetAbs, "dir")},
+		{Kind: OpLink, Source: filepath.Join(stowDirAbs, "new", "alpha.txt"), Target: filepath.Join(targetAbs, "alpha.txt")},
+		{Kind: OpLink, Source: filepath.Join(stowDirAbs, "new", "dir"), Target: filepath.Join(targetAbs, "dir")},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+	}
+	for i, op := range plan.Operations {
+		if op != expected[i] {
+			t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+}
+
+func TestBuildPlanRejectsPruneInActions(t *testing.T) {
+	stowDir := t.TempDir()
+	mustMkdir(t, filepath.Join(stowDir, "pkg"))
+
+	_, err := BuildPlan(Options{
+		Dir:     stowDir,
+		Target:  t.TempDir(),
+		Actions: []PackageAction{{Package: "pkg", Action: ActionPrune}},
+	})
+	if err == nil {
+		t.Fatalf("expected error for prune action")
+	}
+}
+
+func TestBuildPlanNoOpForRelativeSymlink(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	source := filepath.Join(pkg, "alpha.txt")
+	mustWriteFile(t, source)
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	target := filepath.Join(targetDir, "alpha.txt")
+	rel, err := filepath.Rel(targetDir, source)
+	if err != nil {
+		t.Fatalf("rel: %v", err)
+	}
+	if err := os.Symlink(rel, target); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Operations) != 0 || len(plan.Conflicts) != 0 {
+		t.Fatalf("expected empty plan, got %+v", plan)
+	}
+}
+
+func TestBuildPlanContextCancelledDuringWalk(t *testing.T) {
+	stowDir := t.TempDir()
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "alpha.txt"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := BuildPlanContext(ctx, Options{
+		Dir:      stowDir,
+		Target:   t.TempDir(),
+		Packages: []string{"pkg"},
+		Logger:   &cancelLogger{target: pkg, cancel: cancel},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestBuildPlanConcurrencyKeepsOrder(t *testing.T) {
+	m := NewMemFS()
+	stowDir, targetDir := memPath("stow"), memPath("home")
+	for _, rel := range []string{
+		"pkg-a/.config/app/alpha.conf",
+		"pkg-a/.config/shared.conf",
+		"pkg-a/.local/share/a/data.txt",
+		"pkg-b/.config/app/bravo.conf",
+		"pkg-b/.config/shared.conf",
+		"pkg-b/.local/share/b/data.txt",
+		"pkg-c/.bashrc",
+		"pkg-c/.local/share/c/deep/data.txt",
+	} {
+		mustMemWriteFile(t, m, filepath.Join(stowDir, filepath.FromSlash(rel)))
+	}
+	mustMemWriteFile(t, m, filepath.Join(targetDir, ".bashrc"))
+
+	plan := func(concurrency int) PlanResult {
+		result, err := BuildPlan(Options{
+			Dir:         stowDir,
+			Target:      targetDir,
+			Packages:    []string{"pkg-c", "pkg-a", "pkg-b"},
+			Concurrency: concurrency,
+			FS:          m,
+		})
+		if err != nil {
+			t.Fatalf("BuildPlan error: %v", err)
+		}
+		return result
+	}
+	want := plan(1)
+	if len(want.Conflicts) != 2 {
+		t.Fatalf("expected the .bashrc and duplicate shared.conf conflicts, got %+v", want.Conflicts)
+	}
+	for i := 0; i < 20; i++ {
+		if got := plan(8); !reflect.DeepEqual(got, want) {
+			t.Fatalf("plan mismatch:\n got: %+v\nwant: %+v", got, want)
+		}
+	}
+}
+
+func TestBuildPlanThroughSymlinkedDirectories(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// real is the directory reached through the symlink link.
+		real, link  string
+		dir, target string
+	}{
+		{name: "stow dir", real: "src/dot", link: "dot", dir: "dot", target: "home"},
+		{name: "target", real: "deep/x/home", link: "home", dir: "stow", target: "home"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := NewMemFS()
+			if err := m.MkdirAll(memPath(tc.real), 0o755); err != nil {
+				t.Fatalf("MkdirAll error: %v", err)
+			}
+			rel, _ := filepath.Rel(filepath.Dir(memPath(tc.link)), memPath(tc.real))
+			if err := m.Symlink(rel, memPath(tc.link)); err != nil {
+				t.Fatalf("Symlink error: %v", err)
+			}
+			stowDir, targetDir := memPath(tc.dir), memPath(tc.target)
+			if err := m.MkdirAll(targetDir, 0o755); err != nil {
+				t.Fatalf("MkdirAll error: %v", err)
+			}
+			mustMemWriteFile(t, m, filepath.Join(stowDir, "a", ".config", "nvim", "init"))
+			mustMemWriteFile(t, m, filepath.Join(stowDir, "a", ".f"))
+			mustMemWriteFile(t, m, filepath.Join(stowDir, "b", ".config", "zsh", "rc"))
+			opts := func(action Action, packages ...string) Options {
+				return Options{Dir: stowDir, Target: targetDir, Packages: packages, Action: action, FS: m}
+			}
+			apply := func(plan PlanResult) {
+				t.Helper()
+				if len(plan.Conflicts) != 0 {
+					t.Fatalf("unexpected conflicts: %+v", plan.Conflicts)
+				}
+				if err := Execute(plan, ExecuteOptions{FS: m}); err != nil {
+					t.Fatalf("Execute error: %v", err)
+				}
+			}
+
+			plan, err := BuildPlan(opts(ActionStow, "a"))
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			apply(plan)
+
+			restow, err := BuildPlan(opts(ActionRestow, "a"))
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			if len(restow.Operations) != 0 || len(restow.Conflicts) != 0 {
+				t.Fatalf("expected restowing to be a no-op, got %+v", restow)
+			}
+			statuses, err := Status(opts(ActionStow, "a"))
+			if err != nil {
+				t.Fatalf("Status error: %v", err)
+			}
+			if len(statuses) != 1 || statuses[0].Status != StatusStowed {
+				t.Fatalf("expected a to be stowed, got %+v", statuses)
+			}
+
+			// b shares .config, which a folded into a single link.
+			unfold, err := BuildPlan(opts(ActionStow, "b"))
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			if len(unfold.Operations) == 0 || unfold.Operations[0].Kind != OpUnlink {
+				t.Fatalf("expected .config to be unfolded, got %+v", unfold.Operations)
+			}
+			apply(unfold)
+			for _, name := range []string{".config/nvim/init", ".config/zsh/rc", ".f"} {
+				if _, err := m.ReadFile(filepath.Join(targetDir, filepath.FromSlash(name))); err != nil {
+					t.Fatalf("expected %s to lead to the package: %v", name, err)
+				}
+			}
+
+			if err := m.Remove(filepath.Join(stowDir, "a", ".f")); err != nil {
+				t.Fatalf("Remove error: %v", err)
+			}
+			prune, err := BuildPlan(opts(ActionPrune))
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			stale := filepath.Join(targetDir, ".f")
+			if len(prune.Operations) != 1 || prune.Operations[0].Kind != OpUnlink || prune.Operations[0].Target != stale {
+				t.Fatalf("expected prune to unlink %s, got %+v", stale, prune.Operations)
+			}
+		})
+	}
+}
+
 func TestBuildPlanMissingPackage(t *testing.T) {
 	stowDir := t.TempDir()
 	_, err := BuildPlan(Options{
@@ -0,0 +1,129 @@
+package stow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ConflictPolicy selects what BuildPlan does with an existing target that
+// blocks a link.
+type ConflictPolicy int
+
+const (
+	// ConflictSkip reports the conflict and leaves the target alone.
+	ConflictSkip ConflictPolicy = iota
+	// ConflictFail reports the conflicts and makes BuildPlan return a
+	// *ConflictError, so nothing is executed.
+	ConflictFail
+	// ConflictBackup moves the existing target aside (see BackupSuffix and
+	// Options.BackupDir) and links in its place.
+	ConflictBackup
+	// ConflictOverwrite deletes the existing target and links in its place.
+	ConflictOverwrite
+)
+
+// BackupSuffix is appended to the name of a target moved aside by
+// ConflictBackup, followed by ".N" when the name is already taken.
+const BackupSuffix = ".gstow-bak"
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictSkip:
+		return "skip"
+	case ConflictFail:
+		return "fail"
+	case ConflictBackup:
+		return "backup"
+	case ConflictOverwrite:
+		return "overwrite"
+	default:
+		return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+	}
+}
+
+// ParseConflictPolicy returns the policy named by s: skip, fail, backup or
+// overwrite.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for _, p := range []ConflictPolicy{ConflictSkip, ConflictFail, ConflictBackup, ConflictOverwrite} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q (want skip, fail, backup or overwrite)", s)
+}
+
+// ConflictError is returned by BuildPlan under ConflictFail when the plan has
+// conflicts.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Conflicts) == 1 {
+		return "1 conflict"
+	}
+	return fmt.Sprintf("%d conflicts", len(e.Conflicts))
+}
+
+// resolveConflict applies the conflict policy to the existing target that
+// blocks linking sourcePath. It reports whether the target was planned to be
+// moved out of the way; otherwise the conflict is recorded.
+func resolveConflict(sourcePath, targetPath string, kind ConflictKind, state *planState) (bool, error) {
+	switch state.onConflict {
+	case ConflictBackup:
+		backup, err := state.backupPath(targetPath)
+		if err != nil {
+			return false, err
+		}
+		logf(state.log, LevelDecisions, "--- Backing up %s to %s", targetPath, backup)
+		state.addOperation(Operation{
+			Kind:   OpBackup,
+			Source: backup,
+			Target: targetPath,
+		})
+		return true, nil
+	case ConflictOverwrite:
+		logf(state.log, LevelDecisions, "--- Overwriting %s", targetPath)
+		state.addOperation(Operation{
+			Kind:   OpRemove,
+			Source: sourcePath,
+			Target: targetPath,
+		})
+		return true, nil
+	}
+	state.addConflict(targetPath, kind)
+	return false, nil
+}
+
+// backupPath returns a free path to move targetPath to: next to it, or at the
+// same target-relative path below the backup directory, with BackupSuffix and
+// a number when needed.
+func (s *planState) backupPath(targetPath string) (string, error) {
+	base := targetPath
+	if s.backupDir != "" {
+		rel, err := filepath.Rel(s.result.Target, targetPath)
+		if err != nil {
+			return "", &PathError{Path: targetPath, Err: err}
+		}
+		base = filepath.Join(s.backupDir, rel)
+	}
+	base += BackupSuffix
+	for n := 0; ; n++ {
+		candidate := base
+		if n > 0 {
+			candidate += "." + strconv.Itoa(n)
+		}
+		if _, planned := s.backups[candidate]; planned {
+			continue
+		}
+		if _, err := s.fs.Lstat(candidate); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return "", &PathError{Path: candidate, Err: err}
+		}
+		s.backups[candidate] = struct{}{}
+		return candidate, nil
+	}
+}
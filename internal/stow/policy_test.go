@@ -0,0 +1,179 @@
+package stow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, p := range []ConflictPolicy{ConflictSkip, ConflictFail, ConflictBackup, ConflictOverwrite} {
+		got, err := ParseConflictPolicy(p.String())
+		if err != nil || got != p {
+			t.Fatalf("ParseConflictPolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParseConflictPolicy("ask"); err == nil {
+		t.Fatalf("expected error for unknown policy")
+	}
+}
+
+func TestBuildPlanConflictFail(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "bravo.txt"))
+	mustWriteFile(t, filepath.Join(targetDir, "alpha.txt"))
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, OnConflict: ConflictFail})
+	var cerr *ConflictError
+	if !errors.As(err, &cerr) || len(cerr.Conflicts) != 1 {
+		t.Fatalf("expected ConflictError with one conflict, got %v", err)
+	}
+	if len(plan.Conflicts) != 1 {
+		t.Fatalf("expected the plan to carry the conflict, got %+v", plan)
+	}
+}
+
+func TestBuildPlanConflictBackup(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	alpha := filepath.Join(stowDir, "pkg", "alpha.txt")
+	mustWriteFile(t, alpha)
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "bravo.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "dir", "charlie.txt"))
+	existing := filepath.Join(targetDir, "alpha.txt")
+	mustWriteFile(t, existing)
+	mustWriteFile(t, existing+BackupSuffix)
+	// A file where the package has a directory is backed up as well.
+	mustWriteFile(t, filepath.Join(targetDir, "dir"))
+
+	backupDir := filepath.Join(t.TempDir(), "backups")
+	for _, tc := range []struct {
+		backupDir string
+		alpha     string
+		dir       string
+	}{
+		{alpha: existing + BackupSuffix + ".1", dir: filepath.Join(targetDir, "dir") + BackupSuffix},
+		{backupDir: backupDir, alpha: filepath.Join(backupDir, "alpha.txt") + BackupSuffix, dir: filepath.Join(backupDir, "dir") + BackupSuffix},
+	} {
+		plan, err := BuildPlan(Options{
+			Dir:        stowDir,
+			Target:     targetDir,
+			Packages:   []string{"pkg"},
+			OnConflict: ConflictBackup,
+			BackupDir:  tc.backupDir,
+		})
+		if err != nil {
+			t.Fatalf("BuildPlan error: %v", err)
+		}
+		if len(plan.Conflicts) != 0 {
+			t.Fatalf("expected no conflicts, got %+v", plan.Conflicts)
+		}
+		expected := []Operation{
+			{Kind: OpBackup, Source: tc.alpha, Target: existing},
+			{Kind: OpLink, Source: alpha, Target: existing},
+			{Kind: OpLink, Source: filepath.Join(stowDir, "pkg", "bravo.txt"), Target: filepath.Join(targetDir, "bravo.txt")},
+			{Kind: OpBackup, Source: tc.dir, Target: filepath.Join(targetDir, "dir")},
+			{Kind: OpLink, Source: filepath.Join(stowDir, "pkg", "dir"), Target: filepath.Join(targetDir, "dir")},
+		}
+		if len(plan.Operations) != len(expected) {
+			t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+		}
+		for i, op := range plan.Operations {
+			if op != expected[i] {
+				t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+			}
+		}
+	}
+}
+
+func TestExecuteConflictBackupAndOverwrite(t *testing.T) {
+	for _, policy := range []ConflictPolicy{ConflictBackup, ConflictOverwrite} {
+		stowDir := t.TempDir()
+		targetDir := t.TempDir()
+		source := filepath.Join(stowDir, "pkg", "alpha.txt")
+		mustWriteFile(t, source)
+		existing := filepath.Join(targetDir, "alpha.txt")
+		if err := os.WriteFile(existing, []byte("mine"), 0o644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+
+		if !symlinkSupported(t, t.TempDir()) {
+			return
+		}
+		plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, OnConflict: policy})
+		if err != nil {
+			t.Fatalf("%v: BuildPlan error: %v", policy, err)
+		}
+		if err := Execute(plan, ExecuteOptions{}); err != nil {
+			t.Fatalf("%v: Execute error: %v", policy, err)
+		}
+		if ok, err := symlinkMatches(OSFS{}, existing, source); err != nil || !ok {
+			t.Fatalf("%v: expected link to package, got %v %v", policy, ok, err)
+		}
+		entries, err := os.ReadDir(targetDir)
+		if err != nil {
+			t.Fatalf("ReadDir error: %v", err)
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		want := []string{StateFile, "alpha.txt"}
+		if policy == ConflictBackup {
+			want = []string{StateFile, "alpha.txt", "alpha.txt" + BackupSuffix}
+			data, err := os.ReadFile(existing + BackupSuffix)
+			if err != nil || string(data) != "mine" {
+				t.Fatalf("expected backup with original content, got %q %v", data, err)
+			}
+			state, err := LoadState(targetDir)
+			if err != nil {
+				t.Fatalf("LoadState error: %v", err)
+			}
+			key, _ := relSlash(plan.Target, filepath.Join(plan.Dir, "pkg"))
+			backups := []Backup{{Target: "alpha.txt", Path: "alpha.txt" + BackupSuffix}}
+			if pkg := state.Packages[key]; pkg == nil || !reflect.DeepEqual(pkg.Backups, backups) {
+				t.Fatalf("expected the backup to be recorded for %s, got %+v", key, state.Packages)
+			}
+		}
+		if !equalStrings(names, want) {
+			t.Fatalf("%v: unexpected target entries %q, want %q", policy, names, want)
+		}
+	}
+}
+
+func TestExecuteRollsBackBackup(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	existing := filepath.Join(targetDir, "alpha.txt")
+	mustWriteFile(t, existing)
+
+	if !symlinkSupported(t, t.TempDir()) {
+		return
+	}
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, OnConflict: ConflictOverwrite})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	// A second backup whose target is missing fails after the removal.
+	plan.Operations = append(plan.Operations, Operation{
+		Kind:   OpBackup,
+		Source: filepath.Join(targetDir, "missing"+BackupSuffix),
+		Target: filepath.Join(targetDir, "missing"),
+	})
+	if err := Execute(plan, ExecuteOptions{}); err == nil {
+		t.Fatalf("expected Execute error")
+	}
+	info, err := os.Lstat(existing)
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected original file restored, got %v %v", info, err)
+	}
+	entries, err := os.ReadDir(targetDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the original file, got %v %v", entries, err)
+	}
+}
@@ -0,0 +1,177 @@
+package stow
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// buildPrunePlan plans removal of dangling links into the stow directory and
+// of the directories Execute created that would be left empty. The search is
+// bounded by the target directories the packages occupy: the target root, the
+// directories the package trees map to, and the directories and link parents
+// recorded in the state file.
+func buildPrunePlan(ctx context.Context, opts Options, absDir, absTarget string) (*planState, error) {
+	fsys := orOS(opts.FS)
+	record, err := loadState(fsys, absTarget)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := opts.Packages
+	var filter *packageFilter
+	if len(packages) == 0 {
+		if packages, filter, err = prunePackages(fsys, absDir, absTarget, record, opts.Ignore, opts.Exclude); err != nil {
+			return nil, err
+		}
+	} else if packages, err = expandPackages(fsys, absDir, packages, opts.Ignore, opts.Exclude); err != nil {
+		return nil, err
+	}
+
+	state := newPlanState(ctx, fsys, ActionPrune, absDir, absTarget)
+	state.skipped = filter
+	scan := newScanner(ctx, fsys, opts.Dotfiles, opts.Logger, opts.Concurrency)
+	state.ignore = opts.Ignore
+	state.log = opts.Logger
+	created := make(map[string]string)
+	for _, pkg := range packages {
+		pkgPath := filepath.Join(absDir, pkg)
+		dirs := map[string]struct{}{absTarget: {}}
+		info, err := fsys.Stat(pkgPath)
+		switch {
+		case err == nil && info.IsDir():
+			ignore, err := loadIgnoreList(fsys, pkgPath, opts.Ignore)
+			if err != nil {
+				return nil, err
+			}
+			tree, err := scan.withIgnore(ignore).scanPackage(pkgPath)
+			if err != nil {
+				return nil, err
+			}
+			collectTargetDirs(tree, absTarget, dirs)
+		case err != nil && !os.IsNotExist(err):
+			return nil, &PathError{Path: pkgPath, Err: err}
+		}
+
+		if key, ok := relSlash(absTarget, pkgPath); ok {
+			if installed := record.Packages[key]; installed != nil {
+				for _, rel := range installed.Directories {
+					dir := filepath.Join(absTarget, filepath.FromSlash(rel))
+					dirs[dir] = struct{}{}
+					created[dir] = pkgPath
+				}
+				for _, rel := range installed.Links {
+					dirs[filepath.Dir(filepath.Join(absTarget, filepath.FromSlash(rel)))] = struct{}{}
+				}
+			}
+		}
+
+		// Without explicit packages every dangling link into the stow
+		// directory is stale, including links into removed packages.
+		root := pkgPath
+		if len(opts.Packages) == 0 {
+			root = absDir
+		}
+		for _, dir := range sortedPaths(dirs) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := removeStaleLinks(dir, root, state); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Deepest directories first, so a parent sees its pruned children.
+	dirs := make([]string, 0, len(created))
+	for dir := range created {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if err := pruneEmptyDir(created[dir], dir, state); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// prunePackages lists the packages AllPackages stands for together with the
+// packages the state file records there, which may since have been removed.
+// Recorded packages the returned filter skips are left out as well.
+func prunePackages(fsys FS, absDir, absTarget string, record *State, suffixes, exclude []string) ([]string, *packageFilter, error) {
+	packages, filter, err := allPackages(fsys, absDir, suffixes, exclude)
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]struct{}, len(packages))
+	for _, pkg := range packages {
+		seen[pkg] = struct{}{}
+	}
+	for key := range record.Packages {
+		pkgPath := filepath.Join(absTarget, filepath.FromSlash(key))
+		if filepath.Dir(pkgPath) != absDir {
+			continue
+		}
+		name := filepath.Base(pkgPath)
+		if _, ok := seen[name]; !ok && !filter.skips(name) {
+			seen[name] = struct{}{}
+			packages = append(packages, name)
+		}
+	}
+	sort.Strings(packages)
+	return packages, filter, nil
+}
+
+// collectTargetDirs adds the target directory of every directory in the
+// package tree.
+func collectTargetDirs(dir *node, targetDir string, dirs map[string]struct{}) {
+	for _, child := range dir.children {
+		if !child.isDir {
+			continue
+		}
+		path := filepath.Join(targetDir, child.target)
+		dirs[path] = struct{}{}
+		collectTargetDirs(child, path, dirs)
+	}
+}
+
+// pruneEmptyDir plans removal of the real directory at targetPath when it is
+// empty or every entry in it is already planned for removal.
+func pruneEmptyDir(sourcePath, targetPath string, state *planState) error {
+	info, err := state.lstatTarget(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &PathError{Path: targetPath, Err: err}
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	entries, err := state.fs.ReadDir(targetPath)
+	if err != nil {
+		return &PathError{Path: targetPath, Err: err}
+	}
+	for _, entry := range entries {
+		if _, removed := state.removed[filepath.Join(targetPath, entry.Name())]; !removed {
+			return nil
+		}
+	}
+	state.addOperation(Operation{
+		Kind:   OpRmdir,
+		Source: sourcePath,
+		Target: targetPath,
+	})
+	return nil
+}
+
+func sortedPaths(paths map[string]struct{}) []string {
+	out := make([]string, 0, len(paths))
+	for path := range paths {
+		out = append(out, path)
+	}
+	sort.Strings(out)
+	return out
+}
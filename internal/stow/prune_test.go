@@ -0,0 +1,107 @@
+package stow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildPlanPruneRemovesStaleLinks(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	kept := filepath.Join(stowDir, "pkg", "keep.txt")
+	mustWriteFile(t, kept)
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "gone.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "nested", "deep", "file.txt"))
+
+	if !symlinkSupported(t, targetDir) {
+		return
+	}
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, NoFolding: true})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(plan, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(stowDir, "pkg", "gone.txt")); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(stowDir, "pkg", "nested")); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	foreign := filepath.Join(targetDir, "foreign")
+	if err := os.Symlink(filepath.Join(t.TempDir(), "missing"), foreign); err != nil {
+		t.Fatalf("symlink failed: %v", err)
+	}
+
+	plan, err = BuildPlan(Options{Dir: stowDir, Target: targetDir, Action: ActionPrune})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	expected := []struct {
+		kind   OpKind
+		target string
+	}{
+		{kind: OpUnlink, target: filepath.Join(targetDir, "gone.txt")},
+		{kind: OpUnlink, target: filepath.Join(targetDir, "nested", "deep", "file.txt")},
+		{kind: OpRmdir, target: filepath.Join(targetDir, "nested", "deep")},
+		{kind: OpRmdir, target: filepath.Join(targetDir, "nested")},
+	}
+	if len(plan.Operations) != len(expected) {
+		t.Fatalf("expected %d operations, got %+v", len(expected), plan.Operations)
+	}
+	for i, op := range plan.Operations {
+		if op.Kind != expected[i].kind || op.Target != expected[i].target {
+			t.Fatalf("operation %d mismatch: got %+v, want %+v", i, op, expected[i])
+		}
+	}
+
+	if err := Execute(plan, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "nested")); !os.IsNotExist(err) {
+		t.Fatalf("expected nested directory removed, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(targetDir, "keep.txt")); err != nil {
+		t.Fatalf("expected keep.txt link kept: %v", err)
+	}
+	if _, err := os.Lstat(foreign); err != nil {
+		t.Fatalf("expected foreign link kept: %v", err)
+	}
+
+	state, err := LoadState(targetDir)
+	if err != nil {
+		t.Fatalf("LoadState error: %v", err)
+	}
+	pkg := state.Packages["../"+filepath.Base(stowDir)+"/pkg"]
+	if pkg == nil || !equalStrings(pkg.Links, []string{"keep.txt"}) || len(pkg.Directories) != 0 {
+		t.Fatalf("unexpected state %+v", pkg)
+	}
+}
+
+func TestBuildPlanPruneLimitsToNamedPackages(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+	mustMkdir(t, filepath.Join(stowDir, "alpha"))
+	mustMkdir(t, filepath.Join(stowDir, "bravo"))
+
+	if !symlinkSupported(t, targetDir) {
+		return
+	}
+	for _, pkg := range []string{"alpha", "bravo"} {
+		if err := os.Symlink(filepath.Join(stowDir, pkg, "gone"), filepath.Join(targetDir, pkg)); err != nil {
+			t.Fatalf("symlink failed: %v", err)
+		}
+	}
+
+	plan, err := BuildPlan(Options{Dir: stowDir, Target: targetDir, Packages: []string{"alpha"}, Action: ActionPrune})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0].Target != filepath.Join(targetDir, "alpha") {
+		t.Fatalf("expected only alpha link pruned, got %+v", plan.Operations)
+	}
+}
@@ -0,0 +1,235 @@
+package stow
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const dotPrefix = "dot-"
+
+// DefaultConcurrency is the number of directories read at once when
+// Options.Concurrency is zero.
+const DefaultConcurrency = 8
+
+// node is a scanned package entry. Directories hold their children sorted by
+// name; symlinks inside the package are leaves and are never followed. The
+// target name differs from the package name only in dotfiles mode.
+type node struct {
+	name     string
+	target   string
+	path     string
+	isDir    bool
+	children []*node
+	// ignored holds the paths of the ignored entries of a directory. They
+	// are logged once scanning is done, so that the log does not depend on
+	// the order in which directories were read.
+	ignored []string
+}
+
+// scanner reads package trees from fs, skipping entries matched by ignore
+// and the local ignore file. Ignored entries are reported to log at
+// LevelDecisions. Scanning stops with ctx.Err() once ctx is done.
+//
+// Packages and subdirectories are read in parallel, by at most one goroutine
+// per workers token besides the caller; the resulting trees do not depend on
+// the order of the reads.
+type scanner struct {
+	ctx      context.Context
+	fs       FS
+	ignore   *ignoreList
+	dotfiles bool
+	log      Logger
+	// workers is nil when scanning sequentially.
+	workers chan struct{}
+}
+
+func newScanner(ctx context.Context, fsys FS, dotfiles bool, log Logger, concurrency int) *scanner {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	s := &scanner{ctx: ctx, fs: fsys, dotfiles: dotfiles, log: log}
+	if concurrency > 1 {
+		s.workers = make(chan struct{}, concurrency-1)
+	}
+	return s
+}
+
+// withIgnore returns a scanner sharing the workers of s that skips the
+// entries matched by ignore.
+func (s *scanner) withIgnore(ignore *ignoreList) *scanner {
+	scan := *s
+	scan.ignore = ignore
+	return &scan
+}
+
+// spawn runs fn on a new goroutine tracked by wg when a worker is free, and
+// on the calling goroutine otherwise, so it never blocks waiting for one.
+func (s *scanner) spawn(wg *sync.WaitGroup, fn func()) {
+	select {
+	case s.workers <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-s.workers }()
+			fn()
+		}()
+	default:
+		fn()
+	}
+}
+
+// scanPackages checks and reads the packages at pkgPaths in parallel, each
+// with its own ignore list extended by suffixes. The trees are returned in
+// the order of pkgPaths; on failure the error of the first failing package
+// is returned.
+func (s *scanner) scanPackages(pkgPaths, suffixes []string) ([]*node, error) {
+	trees := make([]*node, len(pkgPaths))
+	errs := make([]error, len(pkgPaths))
+	var wg sync.WaitGroup
+	for i, pkgPath := range pkgPaths {
+		s.spawn(&wg, func() {
+			trees[i], errs[i] = s.loadPackage(pkgPath, suffixes)
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, tree := range trees {
+		s.logIgnored(tree)
+	}
+	return trees, nil
+}
+
+// loadPackage checks that pkgPath is a directory and reads it without
+// logging.
+func (s *scanner) loadPackage(pkgPath string, suffixes []string) (*node, error) {
+	info, err := s.fs.Stat(pkgPath)
+	if err != nil {
+		return nil, &PathError{Path: pkgPath, Err: err}
+	}
+	if !info.IsDir() {
+		return nil, &PathError{Path: pkgPath, Err: errors.New("package is not a directory")}
+	}
+	ignore, err := loadIgnoreList(s.fs, pkgPath, suffixes)
+	if err != nil {
+		return nil, err
+	}
+	return s.withIgnore(ignore).scan(pkgPath, "")
+}
+
+// scanPackage reads the package tree rooted at pkgPath.
+func (s *scanner) scanPackage(pkgPath string) (*node, error) {
+	return s.scanTree(pkgPath, "")
+}
+
+// scanTree reads the directory at path, whose package-relative path is rel.
+func (s *scanner) scanTree(path, rel string) (*node, error) {
+	root, err := s.scan(path, rel)
+	if err != nil {
+		return nil, err
+	}
+	s.logIgnored(root)
+	return root, nil
+}
+
+func (s *scanner) scan(path, rel string) (*node, error) {
+	name := filepath.Base(path)
+	root := &node{name: name, target: name, path: path, isDir: true}
+	if err := s.scanDir(root, rel); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (s *scanner) scanDir(dir *node, rel string) error {
+	entries, err := s.fs.ReadDir(dir.path)
+	if err != nil {
+		return &PathError{Path: dir.path, Err: err}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var subdirs []*node
+	for _, entry := range entries {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if rel == "" && entry.Name() == LocalIgnoreFile {
+			continue
+		}
+		if s.ignore.match(filepath.Join(rel, entry.Name())) {
+			dir.ignored = append(dir.ignored, filepath.Join(dir.path, entry.Name()))
+			continue
+		}
+		child := &node{
+			name:   entry.Name(),
+			target: entry.Name(),
+			path:   filepath.Join(dir.path, entry.Name()),
+		}
+		if s.dotfiles {
+			child.target = dotfileName(entry.Name())
+		}
+		if !isSymlink(entry) && entry.IsDir() {
+			child.isDir = true
+			subdirs = append(subdirs, child)
+		}
+		dir.children = append(dir.children, child)
+	}
+
+	errs := make([]error, len(subdirs))
+	var wg sync.WaitGroup
+	for i, child := range subdirs {
+		s.spawn(&wg, func() {
+			errs[i] = s.scanDir(child, filepath.Join(rel, child.name))
+		})
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logIgnored logs the ignored entries of the tree, depth first in name order.
+func (s *scanner) logIgnored(dir *node) {
+	for _, path := range dir.ignored {
+		logf(s.log, LevelDecisions, "--- Ignoring %s", path)
+	}
+	for _, child := range dir.children {
+		if child.isDir {
+			s.logIgnored(child)
+		}
+	}
+}
+
+// dotfileName maps a package entry name to its target name in dotfiles mode:
+// a "dot-" prefix followed by anything other than a dot becomes ".".
+func dotfileName(name string) string {
+	rest := strings.TrimPrefix(name, dotPrefix)
+	if rest == name || rest == "" || rest[0] == '.' {
+		return name
+	}
+	return "." + rest
+}
+
+// countClaims records, for every target-relative path, how many of the
+// scanned packages contain an entry there.
+func countClaims(rel string, dir *node, claims map[string]int) {
+	for _, child := range dir.children {
+		relPath := filepath.Join(rel, child.target)
+		claims[relPath]++
+		if child.isDir {
+			countClaims(relPath, child, claims)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package stow
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScanPackageDoesNotFollowSymlinks(t *testing.T) {
+	stowDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "dir", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "outside", "bravo.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	if err := os.Symlink(filepath.Join(stowDir, "outside"), filepath.Join(pkg, "linked")); err != nil {
+		t.Skipf("symlink creation failed: %v", err)
+	}
+
+	tree, err := newScanner(context.Background(), OSFS{}, false, nil, 0).scanPackage(pkg)
+	if err != nil {
+		t.Fatalf("scanPackage error: %v", err)
+	}
+	if len(tree.children) != 2 {
+		t.Fatalf("expected 2 children, got %d", len(tree.children))
+	}
+	dir, linked := tree.children[0], tree.children[1]
+	if dir.name != "dir" || !dir.isDir || len(dir.children) != 1 {
+		t.Fatalf("unexpected dir node: %+v", dir)
+	}
+	if linked.name != "linked" || linked.isDir || linked.children != nil {
+		t.Fatalf("expected symlinked directory to be a leaf: %+v", linked)
+	}
+}
+
+func TestCountClaims(t *testing.T) {
+	stowDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(stowDir, "pkg-a", "config", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "pkg-b", "config", "bravo.txt"))
+
+	claims := make(map[string]int)
+	for _, pkg := range []string{"pkg-a", "pkg-b"} {
+		tree, err := newScanner(context.Background(), OSFS{}, false, nil, 0).scanPackage(filepath.Join(stowDir, pkg))
+		if err != nil {
+			t.Fatalf("scanPackage error: %v", err)
+		}
+		countClaims("", tree, claims)
+	}
+
+	if claims["config"] != 2 {
+		t.Fatalf("expected config to be claimed twice, got %d", claims["config"])
+	}
+	if claims[filepath.Join("config", "alpha.txt")] != 1 {
+		t.Fatalf("expected alpha.txt to be claimed once, got %d", claims[filepath.Join("config", "alpha.txt")])
+	}
+}
+
+func TestScanPackagesConcurrencyIsDeterministic(t *testing.T) {
+	m := NewMemFS()
+	stowDir := memPath("stow")
+	var pkgPaths []string
+	for _, pkg := range []string{"pkg-a", "pkg-b", "pkg-c", "pkg-d"} {
+		pkgPath := filepath.Join(stowDir, pkg)
+		pkgPaths = append(pkgPaths, pkgPath)
+		for _, rel := range []string{"x/1/alpha.txt", "x/2/bravo.txt", "y/charlie.txt", "y/README.md", "z/3/4/delta.txt", "echo.txt"} {
+			mustMemWriteFile(t, m, filepath.Join(pkgPath, filepath.FromSlash(rel)))
+		}
+	}
+
+	scanAll := func(concurrency int) ([]*node, []string) {
+		log := &recordingLogger{}
+		scan := newScanner(context.Background(), m, false, log, concurrency)
+		trees, err := scan.scanPackages(pkgPaths, []string{`\.md`})
+		if err != nil {
+			t.Fatalf("scanPackages error: %v", err)
+		}
+		return trees, log.messages
+	}
+	wantTrees, wantLog := scanAll(1)
+	for i := 0; i < 20; i++ {
+		trees, log := scanAll(16)
+		if !reflect.DeepEqual(trees, wantTrees) {
+			t.Fatalf("concurrent scan differs from sequential scan")
+		}
+		if !reflect.DeepEqual(log, wantLog) {
+			t.Fatalf("log mismatch:\n got: %q\nwant: %q", log, wantLog)
+		}
+	}
+	if len(wantLog) != len(pkgPaths) {
+		t.Fatalf("expected one ignored entry per package, got %q", wantLog)
+	}
+}
+
+func TestScanPackagesReportsFirstFailure(t *testing.T) {
+	m := NewMemFS()
+	stowDir := memPath("stow")
+	mustMemWriteFile(t, m, filepath.Join(stowDir, "pkg-b", "alpha.txt"))
+
+	scan := newScanner(context.Background(), m, false, nil, 4)
+	missing := filepath.Join(stowDir, "pkg-a")
+	_, err := scan.scanPackages([]string{missing, filepath.Join(stowDir, "pkg-b"), filepath.Join(stowDir, "pkg-c")}, nil)
+	var perr *PathError
+	if !errors.As(err, &perr) || perr.Path != missing {
+		t.Fatalf("expected PathError for %s, got %v", missing, err)
+	}
+}
+
+func TestDotfileName(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{name: "dot-bashrc", expected: ".bashrc"},
+		{name: "dot-config", expected: ".config"},
+		{name: "dot-", expected: "dot-"},
+		{name: "dot-.hidden", expected: "dot-.hidden"},
+		{name: "plain", expected: "plain"},
+		{name: "xdot-file", expected: "xdot-file"},
+	} {
+		if got := dotfileName(tc.name); got != tc.expected {
+			t.Errorf("dotfileName(%q) = %q, want %q", tc.name, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package stow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StateFile is the name of the state file Execute maintains in the target directory.
+const StateFile = ".gstow-state.json"
+
+// StateVersion is the state file schema version written by this package.
+const StateVersion = 1
+
+// State records what Execute has installed into a target directory. Paths are
+// slash-separated and relative to the target directory, so the record stays
+// valid when the target and stow directories move together.
+type State struct {
+	Version int `json:"version"`
+	// Packages is keyed by the package directory.
+	Packages map[string]*PackageState `json:"packages"`
+}
+
+// PackageState lists the links and directories installed for one package,
+// and the existing targets moved aside to make room for its links.
+type PackageState struct {
+	Links       []string `json:"links"`
+	Directories []string `json:"directories"`
+	Backups     []Backup `json:"backups,omitempty"`
+}
+
+// Backup records an existing target that ConflictBackup moved aside. Both
+// paths are slash-separated and relative to the target directory; moving
+// Path back to Target reverts it.
+type Backup struct {
+	Target string `json:"target"`
+	Path   string `json:"path"`
+}
+
+// LoadState reads the state file of the target directory. A missing file
+// yields an empty state.
+func LoadState(target string) (*State, error) {
+	return loadState(OSFS{}, target)
+}
+
+func loadState(fsys FS, target string) (*State, error) {
+	absTarget, err := filepath.Abs(target)
+	if err != nil {
+		return nil, &PathError{Path: target, Err: err}
+	}
+	statePath := filepath.Join(absTarget, StateFile)
+	data, err := fsys.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newState(), nil
+		}
+		return nil, &PathError{Path: statePath, Err: err}
+	}
+	state := newState()
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, &PathError{Path: statePath, Err: err}
+	}
+	if state.Version != StateVersion {
+		return nil, &PathError{Path: statePath, Err: fmt.Errorf("unsupported state version %d", state.Version)}
+	}
+	if state.Packages == nil {
+		state.Packages = make(map[string]*PackageState)
+	}
+	return state, nil
+}
+
+func newState() *State {
+	return &State{Version: StateVersion, Packages: make(map[string]*PackageState)}
+}
+
+// Owner returns the Packages key of the package that installed the link or
+// directory at the target-relative path rel.
+func (s *State) Owner(rel string) (string, bool) {
+	for key, pkg := range s.Packages {
+		if contains(pkg.Links, rel) || contains(pkg.Directories, rel) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// record updates the state for an executed operation of plan; created lists
+// the directories made for it.
+func (s *State) record(plan PlanResult, op Operation, created []string) {
+	rel, ok := relSlash(plan.Target, op.Target)
+	if !ok {
+		return
+	}
+	key, owned := relSlash(plan.Target, plan.packageOf(op.Source))
+	switch op.Kind {
+	case OpLink, OpAdopt:
+		if !owned {
+			return
+		}
+		pkg := s.pkg(key)
+		for _, dir := range created {
+			if relDir, ok := relSlash(plan.Target, dir); ok && relDir != "." {
+				pkg.Directories = append(pkg.Directories, relDir)
+			}
+		}
+		pkg.Links = append(pkg.Links, rel)
+	case OpMkdir:
+		if owned {
+			s.pkg(key).Directories = append(s.pkg(key).Directories, rel)
+		}
+	case OpBackup:
+		for _, pkg := range s.Packages {
+			pkg.Links = remove(pkg.Links, rel)
+		}
+		key, owned := relSlash(plan.Target, plan.packageOf(plan.linkSource(op.Target)))
+		backup, ok := relSlash(plan.Target, op.Source)
+		if owned && ok {
+			pkg := s.pkg(key)
+			pkg.Backups = append(removeBackup(pkg.Backups, rel), Backup{Target: rel, Path: backup})
+		}
+	case OpUnlink, OpRemove:
+		for _, pkg := range s.Packages {
+			pkg.Links = remove(pkg.Links, rel)
+		}
+	case OpRmdir:
+		for _, pkg := range s.Packages {
+			pkg.Directories = remove(pkg.Directories, rel)
+		}
+	}
+}
+
+func (s *State) pkg(key string) *PackageState {
+	pkg, ok := s.Packages[key]
+	if !ok {
+		pkg = &PackageState{}
+		s.Packages[key] = pkg
+	}
+	return pkg
+}
+
+// save writes the state file atomically, dropping packages with no entries.
+func (s *State) save(fsys FS, target string) error {
+	for key, pkg := range s.Packages {
+		pkg.Links = normalize(pkg.Links)
+		pkg.Directories = normalize(pkg.Directories)
+		sort.Slice(pkg.Backups, func(i, j int) bool { return pkg.Backups[i].Target < pkg.Backups[j].Target })
+		if len(pkg.Links) == 0 && len(pkg.Directories) == 0 && len(pkg.Backups) == 0 {
+			delete(s.Packages, key)
+		}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := tempName(fsys, target, StateFile+".*")
+	if err != nil {
+		return err
+	}
+	err = fsys.WriteFile(tmp, append(data, '\n'), 0o600)
+	if err == nil {
+		err = fsys.Rename(tmp, filepath.Join(target, StateFile))
+	}
+	if err != nil {
+		if rerr := fsys.Remove(tmp); rerr != nil && !os.IsNotExist(rerr) {
+			err = errors.Join(err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// linkSource returns the source of the link planned at target, or "".
+func (p PlanResult) linkSource(target string) string {
+	for _, op := range p.Operations {
+		if (op.Kind == OpLink || op.Kind == OpAdopt) && op.Target == target {
+			return op.Source
+		}
+	}
+	return ""
+}
+
+// packageOf returns the package directory that contains the source path.
+func (p PlanResult) packageOf(source string) string {
+	rel, err := filepath.Rel(p.Dir, source)
+	if err != nil || rel == "." || !isWithin(p.Dir, source) {
+		return ""
+	}
+	return filepath.Join(p.Dir, strings.Split(rel, string(filepath.Separator))[0])
+}
+
+func relSlash(base, path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func normalize(paths []string) []string {
+	sort.Strings(paths)
+	out := paths[:0]
+	for i, path := range paths {
+		if i == 0 || path != paths[i-1] {
+			out = append(out, path)
+		}
+	}
+	if len(out) == 0 {
+		return []string{}
+	}
+	return out
+}
+
+func contains(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(paths []string, path string) []string {
+	out := paths[:0]
+	for _, p := range paths {
+		if p != path {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func removeBackup(backups []Backup, target string) []Backup {
+	out := backups[:0]
+	for _, b := range backups {
+		if b.Target != target {
+			out = append(out, b)
+		}
+	}
+	return out
+}
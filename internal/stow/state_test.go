@@ -0,0 +1,111 @@
+package stow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadStateMissingFile(t *testing.T) {
+	state, err := LoadState(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadState error: %v", err)
+	}
+	if state.Version != StateVersion || len(state.Packages) != 0 {
+		t.Fatalf("expected empty state, got %+v", state)
+	}
+}
+
+func TestLoadStateRejectsUnknownVersion(t *testing.T) {
+	targetDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(targetDir, StateFile), []byte(`{"version": 99}`), 0o644); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+
+	if _, err := LoadState(targetDir); err == nil {
+		t.Fatalf("expected error for unsupported version")
+	}
+}
+
+func TestExecuteRecordsState(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	pkg := filepath.Join(stowDir, "pkg")
+	mustWriteFile(t, filepath.Join(pkg, "alpha.txt"))
+	mustWriteFile(t, filepath.Join(pkg, "nested", "deeper", "bravo.txt"))
+
+	if !symlinkSupported(t, stowDir) {
+		return
+	}
+
+	plan, err := BuildPlan(Options{
+		Dir:       stowDir,
+		Target:    targetDir,
+		Packages:  []string{"pkg"},
+		NoFolding: true,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(plan, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	state, err := LoadState(targetDir)
+	if err != nil {
+		t.Fatalf("LoadState error: %v", err)
+	}
+	key, err := filepath.Rel(plan.Target, filepath.Join(plan.Dir, "pkg"))
+	if err != nil {
+		t.Fatalf("rel: %v", err)
+	}
+	pkgState := state.Packages[filepath.ToSlash(key)]
+	if pkgState == nil {
+		t.Fatalf("expected package %q in state, got %+v", key, state.Packages)
+	}
+	expectedLinks := []string{"alpha.txt", "nested/deeper/bravo.txt"}
+	expectedDirs := []string{"nested", "nested/deeper"}
+	if !equalStrings(pkgState.Links, expectedLinks) {
+		t.Fatalf("links mismatch: got %q, want %q", pkgState.Links, expectedLinks)
+	}
+	if !equalStrings(pkgState.Directories, expectedDirs) {
+		t.Fatalf("directories mismatch: got %q, want %q", pkgState.Directories, expectedDirs)
+	}
+	if owner, ok := state.Owner("nested/deeper/bravo.txt"); !ok || owner != filepath.ToSlash(key) {
+		t.Fatalf("unexpected owner %q", owner)
+	}
+
+	plan, err = BuildPlan(Options{
+		Dir:      stowDir,
+		Target:   targetDir,
+		Packages: []string{"pkg"},
+		Action:   ActionDelete,
+	})
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if err := Execute(plan, ExecuteOptions{}); err != nil {
+		t.Fatalf("Execute error: %v", err)
+	}
+
+	state, err = LoadState(targetDir)
+	if err != nil {
+		t.Fatalf("LoadState error: %v", err)
+	}
+	if len(state.Packages) != 0 {
+		t.Fatalf("expected unstowed package to be dropped, got %+v", state.Packages)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package stow
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StowStatus summarizes how much of a package is stowed.
+type StowStatus int
+
+const (
+	// StatusNotStowed means none of the package's entries are linked.
+	StatusNotStowed StowStatus = iota
+	// StatusPartial means some entries are linked but the package has drifted.
+	StatusPartial
+	// StatusStowed means every entry is linked and nothing is stale or conflicting.
+	StatusStowed
+)
+
+func (s StowStatus) String() string {
+	switch s {
+	case StatusNotStowed:
+		return "not stowed"
+	case StatusPartial:
+		return "partial"
+	case StatusStowed:
+		return "stowed"
+	default:
+		return "unknown"
+	}
+}
+
+// PackageStatus reports the stow state of one package.
+type PackageStatus struct {
+	Package string
+	Status  StowStatus
+	// Linked lists targets that already link to their package entry.
+	Linked []Operation
+	// Missing lists the links stowing the package would create.
+	Missing []Operation
+	// Extra lists links into the package whose entries no longer exist.
+	Extra     []Operation
+	Conflicts []Conflict
+}
+
+// Drifted reports whether the package is not fully stowed.
+func (s PackageStatus) Drifted() bool {
+	return s.Status != StatusStowed
+}
+
+// Status reports the stow state of each package in opts.Packages, or of every
+// package in opts.Dir when none are given. Each package is planned on its own
+// as a restow, so the other packages do not affect its result.
+func Status(opts Options) ([]PackageStatus, error) {
+	return StatusContext(context.Background(), opts)
+}
+
+// StatusContext is Status with cancellation; see BuildPlanContext.
+func StatusContext(ctx context.Context, opts Options) ([]PackageStatus, error) {
+	fsys := orOS(opts.FS)
+	packages := opts.Packages
+	var err error
+	if len(packages) == 0 {
+		if packages, _, err = allPackages(fsys, opts.Dir, opts.Ignore, opts.Exclude); err != nil {
+			return nil, err
+		}
+		if len(packages) == 0 {
+			return nil, &PathError{Path: opts.Dir, Err: errors.New("no packages found")}
+		}
+	} else if packages, err = expandPackages(fsys, opts.Dir, packages, opts.Ignore, opts.Exclude); err != nil {
+		return nil, err
+	}
+	packages = append([]string(nil), packages...)
+	sort.Strings(packages)
+
+	statuses := make([]PackageStatus, 0, len(packages))
+	for _, pkg := range packages {
+		pkgOpts := opts
+		pkgOpts.Packages = []string{pkg}
+		pkgOpts.Action = ActionRestow
+		pkgOpts.Adopt = false
+		// Report conflicts instead of planning to move them aside.
+		pkgOpts.OnConflict = ConflictSkip
+		pkgOpts.BackupDir = ""
+		state, err := buildPlan(ctx, pkgOpts)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, packageStatus(pkg, state))
+	}
+	return statuses, nil
+}
+
+func packageStatus(pkg string, state *planState) PackageStatus {
+	status := PackageStatus{
+		Package:   pkg,
+		Linked:    state.linked,
+		Conflicts: state.result.Conflicts,
+	}
+	pkgPath := filepath.Join(state.stowDir, pkg)
+	for _, op := range state.result.Operations {
+		if !isWithin(pkgPath, op.Source) {
+			continue
+		}
+		switch op.Kind {
+		case OpLink:
+			status.Missing = append(status.Missing, op)
+		case OpUnlink:
+			status.Extra = append(status.Extra, op)
+		}
+	}
+
+	switch {
+	case len(status.Missing) == 0 && len(status.Extra) == 0 && len(status.Conflicts) == 0:
+		status.Status = StatusStowed
+	case len(status.Linked) == 0 && len(status.Extra) == 0:
+		status.Status = StatusNotStowed
+	default:
+		status.Status = StatusPartial
+	}
+	return status
+}
+
+// ListPackages returns the packages of the stow directory: its directories,
+// sorted, skipping hidden entries.
+func ListPackages(dir string) ([]string, error) {
+	return listPackages(OSFS{}, dir)
+}
+
+func listPackages(fsys FS, dir string) ([]string, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, &PathError{Path: dir, Err: err}
+	}
+	var packages []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		packages = append(packages, entry.Name())
+	}
+	sort.Strings(packages)
+	return packages, nil
+}
@@ -0,0 +1,95 @@
+package stow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatusReportsPackageStates(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	full := filepath.Join(stowDir, "full", "alpha.txt")
+	partial := filepath.Join(stowDir, "partial", "bravo.txt")
+	mustWriteFile(t, full)
+	mustWriteFile(t, partial)
+	mustWriteFile(t, filepath.Join(stowDir, "partial", "charlie.txt"))
+	mustWriteFile(t, filepath.Join(stowDir, "none", "delta.txt"))
+	mustMkdir(t, filepath.Join(stowDir, ".hidden"))
+
+	if !symlinkSupported(t, targetDir) {
+		return
+	}
+	for _, link := range []struct{ source, target string }{
+		{source: full, target: filepath.Join(targetDir, "alpha.txt")},
+		{source: partial, target: filepath.Join(targetDir, "bravo.txt")},
+		{source: filepath.Join(stowDir, "partial", "gone.txt"), target: filepath.Join(targetDir, "gone.txt")},
+	} {
+		if err := os.Symlink(link.source, link.target); err != nil {
+			t.Skipf("symlink creation failed: %v", err)
+		}
+	}
+
+	statuses, err := Status(Options{Dir: stowDir, Target: targetDir})
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+
+	expected := []struct {
+		pkg     string
+		status  StowStatus
+		missing int
+		extra   int
+	}{
+		{pkg: "full", status: StatusStowed},
+		{pkg: "none", status: StatusNotStowed, missing: 1},
+		{pkg: "partial", status: StatusPartial, missing: 1, extra: 1},
+	}
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %d statuses, got %+v", len(expected), statuses)
+	}
+	for i, status := range statuses {
+		want := expected[i]
+		if status.Package != want.pkg || status.Status != want.status || len(status.Missing) != want.missing || len(status.Extra) != want.extra {
+			t.Fatalf("status %d mismatch: got %+v, want %+v", i, status, want)
+		}
+		if status.Drifted() != (want.status != StatusStowed) {
+			t.Fatalf("unexpected drift for %s", status.Package)
+		}
+	}
+}
+
+func TestStatusReportsConflicts(t *testing.T) {
+	stowDir := t.TempDir()
+	targetDir := t.TempDir()
+
+	mustWriteFile(t, filepath.Join(stowDir, "pkg", "alpha.txt"))
+	mustWriteFile(t, filepath.Join(targetDir, "alpha.txt"))
+
+	for _, policy := range []ConflictPolicy{ConflictSkip, ConflictBackup, ConflictOverwrite} {
+		statuses, err := Status(Options{Dir: stowDir, Target: targetDir, Packages: []string{"pkg"}, OnConflict: policy})
+		if err != nil {
+			t.Fatalf("Status error: %v", err)
+		}
+		if len(statuses) != 1 || len(statuses[0].Conflicts) != 1 || !statuses[0].Drifted() {
+			t.Fatalf("%s: expected one drifted package with a conflict, got %+v", policy, statuses)
+		}
+	}
+}
+
+func TestListPackages(t *testing.T) {
+	stowDir := t.TempDir()
+	mustMkdir(t, filepath.Join(stowDir, "zsh"))
+	mustMkdir(t, filepath.Join(stowDir, "bash"))
+	mustMkdir(t, filepath.Join(stowDir, ".git"))
+	mustWriteFile(t, filepath.Join(stowDir, "README.md"))
+
+	packages, err := ListPackages(stowDir)
+	if err != nil {
+		t.Fatalf("ListPackages error: %v", err)
+	}
+	if !equalStrings(packages, []string{"bash", "zsh"}) {
+		t.Fatalf("unexpected packages %q", packages)
+	}
+}
@@ -0,0 +1,19 @@
+package stow
+
+import "github.com/beppler/gstow/internal/stow"
+
+// ErrNoPackages is returned when there are no packages to plan.
+var ErrNoPackages = stow.ErrNoPackages
+
+type (
+	// PathError is returned by planning for a path that cannot be read or
+	// is not what it should be.
+	PathError = stow.PathError
+	// OpError is returned by Apply for the operation that failed or, when
+	// cancelled, was not started. The changes already made have been undone
+	// except for the operations listed in Applied.
+	OpError = stow.OpError
+	// ConflictError is returned by planning under ConflictFail when there
+	// are conflicts. The plan is returned with it but must not be applied.
+	ConflictError = stow.ConflictError
+)
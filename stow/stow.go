@@ -0,0 +1,232 @@
+// Package stow manages a symlink farm the way GNU Stow does: the packages of
+// a stow directory are linked into, and removed from, a target directory.
+//
+// A Stower plans changes first and applies them separately, so callers can
+// inspect the operations and conflicts in between:
+//
+//	s, err := stow.New("/home/me/dotfiles", stow.WithTarget("/home/me"))
+//	if err != nil {
+//		return err
+//	}
+//	plan, err := s.Plan(ctx, stow.PackageAction{Package: "vim", Action: stow.ActionStow})
+//	if err != nil {
+//		return err
+//	}
+//	return s.Apply(ctx, plan)
+//
+// Stow, Unstow and Restow do both steps at once.
+package stow
+
+import (
+	"context"
+
+	"github.com/beppler/gstow/internal/stow"
+)
+
+// Stower stows packages of one stow directory into one target directory. It
+// holds no state between calls and is safe for concurrent use as long as the
+// calls do not touch the same targets.
+type Stower struct {
+	dir      string
+	target   string
+	opts     stow.Options
+	execOpts stow.ExecuteOptions
+}
+
+// Option configures a Stower.
+type Option func(*Stower)
+
+// New returns a Stower for the stow directory dir. The target directory
+// defaults to the parent of dir.
+func New(dir string, opts ...Option) (*Stower, error) {
+	s := &Stower{dir: dir}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.target == "" {
+		target, err := stow.DefaultTarget(dir)
+		if err != nil {
+			return nil, &PathError{Path: dir, Err: err}
+		}
+		s.target = target
+	}
+	return s, nil
+}
+
+// WithTarget sets the target directory.
+func WithTarget(dir string) Option {
+	return func(s *Stower) { s.target = dir }
+}
+
+// WithNoFolding makes planning always create directories in the target and
+// link only leaf entries, instead of linking whole package directories.
+func WithNoFolding(noFolding bool) Option {
+	return func(s *Stower) { s.opts.NoFolding = noFolding }
+}
+
+// WithAdopt moves existing regular files found at target paths into the
+// package, replacing the package copy, instead of reporting conflicts.
+func WithAdopt(adopt bool) Option {
+	return func(s *Stower) { s.opts.Adopt = adopt }
+}
+
+// WithIgnore adds regular expressions; package entries whose package-relative
+// path ends with a match are skipped.
+func WithIgnore(patterns ...string) Option {
+	return func(s *Stower) { s.opts.Ignore = append(s.opts.Ignore, patterns...) }
+}
+
+// WithDefer adds regular expressions matched against the start of
+// target-relative paths; matching targets already stowed by another package
+// are left to that package.
+func WithDefer(patterns ...string) Option {
+	return func(s *Stower) { s.opts.Defer = append(s.opts.Defer, patterns...) }
+}
+
+// WithOverride adds regular expressions matched against the start of
+// target-relative paths; matching targets already stowed by another package
+// are relinked.
+func WithOverride(patterns ...string) Option {
+	return func(s *Stower) { s.opts.Override = append(s.opts.Override, patterns...) }
+}
+
+// WithExclude adds shell patterns of package names that package name
+// patterns, such as AllPackages, skip.
+func WithExclude(patterns ...string) Option {
+	return func(s *Stower) { s.opts.Exclude = append(s.opts.Exclude, patterns...) }
+}
+
+// WithDotfiles maps package entries named "dot-x" to targets named ".x".
+func WithDotfiles(dotfiles bool) Option {
+	return func(s *Stower) { s.opts.Dotfiles = dotfiles }
+}
+
+// WithConflictPolicy selects how existing targets that block a link are
+// handled. The default is ConflictSkip.
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(s *Stower) { s.opts.OnConflict = policy }
+}
+
+// WithBackupDir places ConflictBackup backups below dir, at their
+// target-relative paths, instead of next to the targets.
+func WithBackupDir(dir string) Option {
+	return func(s *Stower) { s.opts.BackupDir = dir }
+}
+
+// WithAbsoluteLinks makes Apply create links holding absolute paths instead
+// of paths relative to the link's directory.
+func WithAbsoluteLinks(absolute bool) Option {
+	return func(s *Stower) { s.execOpts.Absolute = absolute }
+}
+
+// WithDryRun makes Apply log the operations without changing anything.
+func WithDryRun(dryRun bool) Option {
+	return func(s *Stower) { s.execOpts.DryRun = dryRun }
+}
+
+// WithConcurrency bounds how many package directories are read at once
+// while planning. Zero means DefaultConcurrency and 1 reads them one at a
+// time.
+func WithConcurrency(n int) Option {
+	return func(s *Stower) { s.opts.Concurrency = n }
+}
+
+// WithLogger sends planning decisions and applied operations to log.
+func WithLogger(log Logger) Option {
+	return func(s *Stower) {
+		s.opts.Logger = log
+		s.execOpts.Logger = log
+	}
+}
+
+// WithFS makes the Stower work on fsys instead of the operating system's
+// filesystem.
+func WithFS(fsys FS) Option {
+	return func(s *Stower) {
+		s.opts.FS = fsys
+		s.execOpts.FS = fsys
+	}
+}
+
+// Dir returns the stow directory.
+func (s *Stower) Dir() string {
+	return s.dir
+}
+
+// Target returns the target directory.
+func (s *Stower) Target() string {
+	return s.target
+}
+
+func (s *Stower) options() stow.Options {
+	opts := s.opts
+	opts.Dir = s.dir
+	opts.Target = s.target
+	return opts
+}
+
+// Plan plans the actions without changing anything. Deletions are planned
+// first, so targets they free can be used by the other packages. Under
+// ConflictFail a plan with conflicts is returned with a *ConflictError.
+func (s *Stower) Plan(ctx context.Context, actions ...PackageAction) (Plan, error) {
+	if len(actions) == 0 {
+		return Plan{}, ErrNoPackages
+	}
+	opts := s.options()
+	opts.Actions = actions
+	return stow.BuildPlanContext(ctx, opts)
+}
+
+// PlanPrune plans the removal of dangling links into the packages, or into
+// the whole stow directory when no packages are given, and of the
+// directories left empty.
+func (s *Stower) PlanPrune(ctx context.Context, packages ...string) (Plan, error) {
+	opts := s.options()
+	opts.Packages = packages
+	opts.Action = stow.ActionPrune
+	return stow.BuildPlanContext(ctx, opts)
+}
+
+// Apply performs the operations of plan, which should come from this
+// Stower. Conflicting targets are left alone. If an operation fails or ctx is
+// cancelled, the changes already made are undone and an *OpError is
+// returned; its Applied field lists any operation that could not be undone.
+func (s *Stower) Apply(ctx context.Context, plan Plan) error {
+	return stow.ExecuteContext(ctx, plan, s.execOpts)
+}
+
+// Stow plans and applies stowing the packages.
+func (s *Stower) Stow(ctx context.Context, packages ...string) (Plan, error) {
+	return s.run(ctx, ActionStow, packages)
+}
+
+// Unstow plans and applies removing the packages' links.
+func (s *Stower) Unstow(ctx context.Context, packages ...string) (Plan, error) {
+	return s.run(ctx, ActionDelete, packages)
+}
+
+// Restow plans and applies restowing the packages, which also removes links
+// to package entries that no longer exist.
+func (s *Stower) Restow(ctx context.Context, packages ...string) (Plan, error) {
+	return s.run(ctx, ActionRestow, packages)
+}
+
+func (s *Stower) run(ctx context.Context, action Action, packages []string) (Plan, error) {
+	actions := make([]PackageAction, 0, len(packages))
+	for _, pkg := range packages {
+		actions = append(actions, PackageAction{Package: pkg, Action: action})
+	}
+	plan, err := s.Plan(ctx, actions...)
+	if err != nil {
+		return plan, err
+	}
+	return plan, s.Apply(ctx, plan)
+}
+
+// Status reports the stow state of each package, or of every package in the
+// stow directory when none are given.
+func (s *Stower) Status(ctx context.Context, packages ...string) ([]PackageStatus, error) {
+	opts := s.options()
+	opts.Packages = packages
+	return stow.StatusContext(ctx, opts)
+}
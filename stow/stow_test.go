@@ -0,0 +1,144 @@
+package stow
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newMemStower returns a Stower over an in-memory stow directory holding a
+// "vim" package with .vimrc and a "bash" package with .bashrc, and a target
+// directory whose existing .bashrc conflicts with the bash package.
+func newMemStower(t *testing.T, opts ...Option) (*Stower, *MemFS) {
+	t.Helper()
+	m := NewMemFS()
+	root := filepath.VolumeName(os.TempDir()) + string(filepath.Separator)
+	stowDir := filepath.Join(root, "dotfiles")
+	target := filepath.Join(root, "home")
+	for _, dir := range []string{filepath.Join(stowDir, "vim"), filepath.Join(stowDir, "bash"), target} {
+		if err := m.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("MkdirAll error: %v", err)
+		}
+	}
+	for _, file := range []string{
+		filepath.Join(stowDir, "vim", ".vimrc"),
+		filepath.Join(stowDir, "bash", ".bashrc"),
+		filepath.Join(target, ".bashrc"),
+	} {
+		if err := m.WriteFile(file, []byte("data"), 0o644); err != nil {
+			t.Fatalf("WriteFile error: %v", err)
+		}
+	}
+	s, err := New(stowDir, append([]Option{WithTarget(target), WithFS(m)}, opts...)...)
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	return s, m
+}
+
+func TestStowerStowStatusUnstow(t *testing.T) {
+	ctx := context.Background()
+	s, m := newMemStower(t)
+	link := filepath.Join(s.Target(), ".vimrc")
+
+	plan, err := s.Stow(ctx, "vim")
+	if err != nil {
+		t.Fatalf("Stow error: %v", err)
+	}
+	if len(plan.Operations) != 1 || plan.Operations[0].Kind != OpLink || plan.Operations[0].Target != link {
+		t.Fatalf("unexpected operations: %+v", plan.Operations)
+	}
+	if info, err := m.Lstat(link); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Fatalf("expected %s to be a symlink: %v", link, err)
+	}
+
+	statuses, err := s.Status(ctx, "vim")
+	if err != nil {
+		t.Fatalf("Status error: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Status != StatusStowed {
+		t.Fatalf("expected vim to be stowed, got %+v", statuses)
+	}
+
+	if _, err := s.Unstow(ctx, "vim"); err != nil {
+		t.Fatalf("Unstow error: %v", err)
+	}
+	if _, err := m.Lstat(link); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", link, err)
+	}
+}
+
+func TestStowerPlanDoesNotApply(t *testing.T) {
+	ctx := context.Background()
+	s, m := newMemStower(t)
+
+	plan, err := s.Plan(ctx, PackageAction{Package: "vim", Action: ActionStow})
+	if err != nil {
+		t.Fatalf("Plan error: %v", err)
+	}
+	if len(plan.Operations) != 1 {
+		t.Fatalf("expected one operation, got %+v", plan.Operations)
+	}
+	if _, err := m.Lstat(filepath.Join(s.Target(), ".vimrc")); !os.IsNotExist(err) {
+		t.Fatalf("expected Plan to change nothing, got %v", err)
+	}
+}
+
+func TestStowerErrors(t *testing.T) {
+	s, _ := newMemStower(t, WithConflictPolicy(ConflictFail))
+
+	if _, err := s.Plan(context.Background()); !errors.Is(err, ErrNoPackages) {
+		t.Fatalf("expected ErrNoPackages, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Stow(ctx, "vim"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	plan, err := s.Stow(context.Background(), "bash")
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) || len(conflictErr.Conflicts) != 1 {
+		t.Fatalf("expected a ConflictError with one conflict, got %v", err)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Kind != ConflictTargetExists {
+		t.Fatalf("unexpected conflicts: %+v", plan.Conflicts)
+	}
+
+	_, err = s.Stow(context.Background(), "missing")
+	var pathErr *PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != filepath.Join(s.Dir(), "missing") {
+		t.Fatalf("expected a PathError for the missing package, got %v", err)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	stowDir, target := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(stowDir, "vim"), 0o755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(stowDir, "vim", ".vimrc"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	s, err := New(stowDir, WithTarget(target))
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	if _, err := s.Stow(context.Background(), "vim"); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	state, err := LoadState(target)
+	if err != nil {
+		t.Fatalf("LoadState error: %v", err)
+	}
+	key, _ := filepath.Rel(target, filepath.Join(stowDir, "vim"))
+	pkg := state.Packages[filepath.ToSlash(key)]
+	if state.Version != StateVersion || pkg == nil || len(pkg.Links) != 1 || pkg.Links[0] != ".vimrc" {
+		t.Fatalf("expected the .vimrc link to be recorded, got %+v", state)
+	}
+}
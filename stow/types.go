@@ -0,0 +1,173 @@
+package stow
+
+import (
+	"io"
+
+	"github.com/beppler/gstow/internal/stow"
+)
+
+// Plans and their parts.
+type (
+	// Plan is the set of operations and conflicts produced by planning.
+	// Dir and Target are absolute.
+	Plan = stow.PlanResult
+	// Operation is one planned filesystem change to Target involving Source.
+	Operation = stow.Operation
+	// OpKind identifies the change an Operation makes.
+	OpKind = stow.OpKind
+	// Conflict is a target that cannot be linked.
+	Conflict = stow.Conflict
+	// ConflictKind classifies a Conflict.
+	ConflictKind = stow.ConflictKind
+	// FileType is the type of the file found at a conflicting target.
+	FileType = stow.FileType
+)
+
+// Operation kinds.
+const (
+	OpLink   = stow.OpLink
+	OpUnlink = stow.OpUnlink
+	OpMkdir  = stow.OpMkdir
+	OpRmdir  = stow.OpRmdir
+	OpAdopt  = stow.OpAdopt
+	OpBackup = stow.OpBackup
+	OpRemove = stow.OpRemove
+)
+
+// Conflict kinds.
+const (
+	ConflictTargetExists    = stow.ConflictTargetExists
+	ConflictLinkElsewhere   = stow.ConflictLinkElsewhere
+	ConflictNotSymlink      = stow.ConflictNotSymlink
+	ConflictDuplicateTarget = stow.ConflictDuplicateTarget
+)
+
+// File types.
+const (
+	FileNone      = stow.FileNone
+	FileRegular   = stow.FileRegular
+	FileDirectory = stow.FileDirectory
+	FileSymlink   = stow.FileSymlink
+	FileOther     = stow.FileOther
+)
+
+// Action selects what is done with a package.
+type Action = stow.Action
+
+// PackageAction pairs a package with the action to apply to it.
+type PackageAction = stow.PackageAction
+
+// AllPackages, used as a package name, stands for every package of the stow
+// directory that is not hidden, ignored or excluded. Other names holding shell
+// pattern characters (*, ? or [) stand for the packages they match.
+const AllPackages = stow.AllPackages
+
+// Actions. ActionPrune is only planned by Stower.PlanPrune.
+const (
+	ActionStow   = stow.ActionStow
+	ActionDelete = stow.ActionDelete
+	ActionRestow = stow.ActionRestow
+	ActionPrune  = stow.ActionPrune
+)
+
+// ConflictPolicy selects what happens to an existing target that blocks a
+// link.
+type ConflictPolicy = stow.ConflictPolicy
+
+// Conflict policies.
+const (
+	ConflictSkip      = stow.ConflictSkip
+	ConflictFail      = stow.ConflictFail
+	ConflictBackup    = stow.ConflictBackup
+	ConflictOverwrite = stow.ConflictOverwrite
+)
+
+// BackupSuffix is appended to the name of a target moved aside by
+// ConflictBackup.
+const BackupSuffix = stow.BackupSuffix
+
+// ParseConflictPolicy returns the policy named by s: skip, fail, backup or
+// overwrite.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	return stow.ParseConflictPolicy(s)
+}
+
+// PackageStatus reports the stow state of one package.
+type PackageStatus = stow.PackageStatus
+
+// StowStatus summarizes how much of a package is stowed.
+type StowStatus = stow.StowStatus
+
+// Package states.
+const (
+	StatusNotStowed = stow.StatusNotStowed
+	StatusPartial   = stow.StatusPartial
+	StatusStowed    = stow.StatusStowed
+)
+
+// DefaultConcurrency is the number of package directories read at once
+// unless WithConcurrency says otherwise.
+const DefaultConcurrency = stow.DefaultConcurrency
+
+// StateFile is the name of the file recording what was installed into a
+// target directory.
+const StateFile = stow.StateFile
+
+// StateVersion is the state file schema version this package writes.
+const StateVersion = stow.StateVersion
+
+// The state file.
+type (
+	// State records what Apply has installed into a target directory. Paths
+	// are slash-separated and relative to the target directory.
+	State = stow.State
+	// PackageState lists the links and directories installed for one
+	// package and the targets moved aside for its links.
+	PackageState = stow.PackageState
+	// Backup records a target moved aside by ConflictBackup.
+	Backup = stow.Backup
+)
+
+// LoadState reads the state file of the target directory. A missing file
+// yields an empty state.
+func LoadState(target string) (*State, error) {
+	return stow.LoadState(target)
+}
+
+// Logger receives verbose messages from planning and execution.
+type Logger = stow.Logger
+
+// Verbosity levels passed to Logger.Logf.
+const (
+	LevelOps       = stow.LevelOps
+	LevelDecisions = stow.LevelDecisions
+	LevelTrace     = stow.LevelTrace
+)
+
+// NewLogger returns a Logger that writes messages up to verbosity to w, one
+// per line.
+func NewLogger(w io.Writer, verbosity int) Logger {
+	return stow.NewLogger(w, verbosity)
+}
+
+// Filesystems.
+type (
+	// FS is the filesystem a Stower plans against and changes.
+	FS = stow.FS
+	// OSFS is the FS of the operating system, used by default.
+	OSFS = stow.OSFS
+	// MemFS is an in-memory FS with symlinks, permissions and injectable
+	// errors.
+	MemFS = stow.MemFS
+)
+
+// NewMemFS returns an empty in-memory filesystem.
+func NewMemFS() *MemFS {
+	return stow.NewMemFS()
+}
+
+// DefaultTarget returns the default target directory for a stow directory:
+// its parent.
+func DefaultTarget(dir string) (string, error) {
+	return stow.DefaultTarget(dir)
+}